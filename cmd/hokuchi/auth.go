@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"os"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi/server"
+	"gopkg.in/yaml.v3"
+)
+
+// minTokenLength keeps guessable tokens out of the tokens file.
+const minTokenLength = 16
+
+// loadTokens reads a YAML list of admin API tokens. No tokens are accepted when path is empty.
+func loadTokens(path string) ([]server.Token, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+
+	var tokens []server.Token
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&tokens); err != nil && err != io.EOF {
+		return nil, errtrace.Errorf("%s: %w", path, err)
+	}
+
+	seen := make(map[string]bool, len(tokens))
+	for i, t := range tokens {
+		switch {
+		case t.Name == "":
+			return nil, errtrace.Errorf("%s: token %d has no name", path, i)
+		case t.Role == server.RoleNone:
+			return nil, errtrace.Errorf("%s: token %q has no role", path, t.Name)
+		case len(t.Token) < minTokenLength:
+			return nil, errtrace.Errorf("%s: token %q is shorter than %d characters", path, t.Name, minTokenLength)
+		case seen[t.Token]:
+			return nil, errtrace.Errorf("%s: token %q is not unique", path, t.Name)
+		}
+		seen[t.Token] = true
+	}
+	return tokens, nil
+}
+
+// requireClientCerts makes a TLS listener verify client certificates against the CA bundle at path.
+// Callers without a certificate may still authenticate with a token.
+func requireClientCerts(tc *tls.Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return errtrace.Errorf("%s: no certificates found", path)
+	}
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.VerifyClientCertIfGiven
+	return nil
+}
+
+// minSigningKeyLength is the shortest URL signing secret accepted, in bytes.
+const minSigningKeyLength = 32
+
+// loadSigningKey reads the URL signing secret, or generates one that lasts for the process when path is empty.
+func loadSigningKey(path string) ([]byte, error) {
+	if path == "" {
+		key := make([]byte, minSigningKeyLength)
+		if _, err := rand.Read(key); err != nil {
+			return nil, errtrace.Wrap(err)
+		}
+		return key, nil
+	}
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) < minSigningKeyLength {
+		return nil, errtrace.Errorf("%s: signing key is shorter than %d bytes", path, minSigningKeyLength)
+	}
+	return key, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"braces.dev/errtrace"
+)
+
+// commands are subcommands that talk to a running hokuchi through its admin API.
+var commands = map[string]func(args []string) int{
+	"machines": runMachines,
+	"rearm":    runRearm,
+	"approve":  runApprove,
+}
+
+type adminClient struct {
+	baseURL string
+	token   string
+	caFile  string
+	cert    string
+	key     string
+	http    *http.Client
+}
+
+func newAdminClientFlags(fs *flag.FlagSet) *adminClient {
+	c := &adminClient{}
+	defaultURL := os.Getenv("HOKUCHI_ADMIN_URL")
+	if defaultURL == "" {
+		defaultURL = "http://127.0.0.1:8081"
+	}
+	fs.StringVar(&c.baseURL, "admin.url", defaultURL, "admin API base URL")
+	fs.StringVar(&c.token, "admin.token", os.Getenv("HOKUCHI_ADMIN_TOKEN"), "admin API bearer token")
+	fs.StringVar(&c.caFile, "admin.ca", os.Getenv("HOKUCHI_ADMIN_CA"), "PEM CA bundle verifying the admin API server")
+	fs.StringVar(&c.cert, "admin.cert", os.Getenv("HOKUCHI_ADMIN_CERT"), "PEM client certificate for the admin API")
+	fs.StringVar(&c.key, "admin.key", os.Getenv("HOKUCHI_ADMIN_KEY"), "PEM private key for admin.cert")
+	return c
+}
+
+func (c *adminClient) client() (*http.Client, error) {
+	if c.http != nil {
+		return c.http, nil
+	}
+	tc := &tls.Config{}
+	if c.caFile != "" {
+		data, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return nil, errtrace.Wrap(err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errtrace.Errorf("%s: no certificates found", c.caFile)
+		}
+	}
+	if c.cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.cert, c.key)
+		if err != nil {
+			return nil, errtrace.Wrap(err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tc
+	c.http = &http.Client{Timeout: 30 * time.Second, Transport: transport}
+	return c.http, nil
+}
+
+func (c *adminClient) do(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return errtrace.Wrap(err)
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.baseURL, "/")+path, body)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	hc, err := c.client()
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&apiErr)
+		return errtrace.Errorf("%s: %s", resp.Status, apiErr.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return errtrace.Wrap(json.NewDecoder(resp.Body).Decode(out))
+}
+
+func printErr(err error) int {
+	fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	return 1
+}
@@ -1,67 +1,681 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi"
+	"github.com/tosuke/hokuchi/flatcar"
+	"github.com/tosuke/hokuchi/profile"
+	"github.com/tosuke/hokuchi/server"
+	"gopkg.in/yaml.v3"
 )
 
 var (
-	flagHelp      bool
-	flagHttpAddr  string
-	flagLogLevel  string
-	flagDataPath  string
-	flagCachePath string
+	flagHelp              bool
+	flagConfigPath        string
+	flagHttpAddr          string
+	flagAdminAddr         string
+	flagMetricsAddr       string
+	flagHttpTLSCert       string
+	flagHttpTLSKey        string
+	flagAdminTLSCert      string
+	flagAdminTLSKey       string
+	flagLogLevel          string
+	flagAssetsPath        string
+	flagDataPath          string
+	flagCachePath         string
+	flagStatePath         string
+	flagScrubInterval     time.Duration
+	flagStorageQuota      int64
+	flagOTLPEndpoint      string
+	flagOTLPInsecure      bool
+	flagOTLPRatio         float64
+	flagMirrorURL         string
+	flagTrustedKeys       stringList
+	flagFetchConcurrency  int
+	flagProfileSources    stringList
+	flagFallbackProfiles  = stringList{"amd64=" + defaultProfileAMD64.ID, "arm64=" + defaultProfileARM64.ID}
+	flagAuthTokensFile    string
+	flagAuthClientCA      string
+	flagAuthClientRoles   stringList
+	flagURLKeyFile        string
+	flagURLTTL            time.Duration
+	flagURLBootedTTL      time.Duration
+	flagURLBindIP         bool
+	flagSecretsDir        string
+	flagHttpAllowedCIDRs  stringList
+	flagAdminAllowedCIDRs stringList
+	flagDiscovery         bool
+	flagDiscoveryInterval time.Duration
 )
 
 func init() {
 	flag.BoolVar(&flagHelp, "help", false, "print usage and exit")
+	flag.StringVar(&flagConfigPath, "config", "", "YAML configuration file, reloaded on SIGHUP")
 	flag.StringVar(&flagHttpAddr, "http.address", "127.0.0.1:8080", "HTTP server listen address")
+	flag.StringVar(&flagAdminAddr, "admin.address", "127.0.0.1:8081", "admin API listen address (empty to disable)")
+	flag.StringVar(&flagMetricsAddr, "metrics.address", "", "metrics listen address (empty to serve metrics on the admin listener)")
+	flag.StringVar(&flagHttpTLSCert, "http.tls.cert", "", "PEM certificate file enabling HTTPS on the boot listener")
+	flag.StringVar(&flagHttpTLSKey, "http.tls.key", "", "PEM private key file for http.tls.cert")
+	flag.StringVar(&flagAdminTLSCert, "admin.tls.cert", "", "PEM certificate file enabling HTTPS on the admin listener")
+	flag.StringVar(&flagAdminTLSKey, "admin.tls.key", "", "PEM private key file for admin.tls.cert")
+	flag.Var(&flagHttpAllowedCIDRs, "http.allowed-cidrs", "comma-separated networks allowed to boot from the HTTP listener (empty allows any)")
+	flag.Var(&flagAdminAllowedCIDRs, "admin.allowed-cidrs", "comma-separated networks allowed to use the admin API (empty allows any)")
 	flag.StringVar(&flagLogLevel, "log.level", "info", "logging level")
+	flag.StringVar(&flagAssetsPath, "assets.path", "assets", "directory holding the iPXE boot binaries")
 	flag.StringVar(&flagDataPath, "data.path", "/var/lib/hokuchi", "data directory")
 	flag.StringVar(&flagCachePath, "cache.path", "/tmp", "cache directory")
+	flag.StringVar(&flagStatePath, "state.path", "", "state database file (defaults to .state.db in the data directory)")
+	flag.Int64Var(&flagStorageQuota, "storage.quota", 0, "maximum bytes of stored artifacts (0 for unlimited)")
+	flag.DurationVar(&flagScrubInterval, "scrub.interval", 24*time.Hour, "interval between storage integrity checks")
+	flag.StringVar(&flagOTLPEndpoint, "otlp.endpoint", "", "OTLP/HTTP collector host:port for traces (empty to disable)")
+	flag.BoolVar(&flagOTLPInsecure, "otlp.insecure", false, "export traces over plain HTTP")
+	flag.Float64Var(&flagOTLPRatio, "otlp.sample-ratio", 1, "fraction of new traces to sample")
+	flag.StringVar(&flagMirrorURL, "mirror.url", flatcar.DefaultMirrorURL, "Flatcar release URL with {channel}, {arch} and {version} placeholders")
+	flag.Var(&flagTrustedKeys, "mirror.trusted-keys", "comma-separated armored public key files trusted for release signatures (defaults to the Flatcar signing key)")
+	flag.IntVar(&flagFetchConcurrency, "fetch.concurrency", 8, "maximum concurrent requests to the mirror")
+	flag.StringVar(&flagAuthTokensFile, "auth.tokens-file", "", "YAML file listing admin API bearer tokens, reloaded on SIGHUP")
+	flag.StringVar(&flagAuthClientCA, "auth.client-ca", "", "PEM CA bundle verifying admin API client certificates (requires admin TLS)")
+	flag.Var(&flagAuthClientRoles, "auth.client-roles", "comma-separated cn=role pairs granting roles to client certificates")
+	flag.StringVar(&flagURLKeyFile, "urls.signing-key-file", "", "file holding the secret that signs artifact and ignition URLs (random per process when empty)")
+	flag.DurationVar(&flagURLTTL, "urls.ttl", time.Hour, "how long signed artifact and ignition URLs stay valid")
+	flag.DurationVar(&flagURLBootedTTL, "urls.booted-ttl", 24*time.Hour, "how long the signed URL a booted system reports back with stays valid")
+	flag.BoolVar(&flagURLBindIP, "urls.bind-ip", false, "bind signed artifact URLs to the client address that requested the boot script")
+	flag.BoolVar(&flagDiscovery, "discovery.enabled", false, "hold machines seen for the first time until an operator approves them")
+	flag.DurationVar(&flagDiscoveryInterval, "discovery.interval", 30*time.Second, "how often held machines ask whether they have been approved")
+	flag.StringVar(&flagSecretsDir, "secrets.dir", "", "directory of files resolving ${secret:NAME} references in profiles (HOKUCHI_SECRET_NAME variables are consulted too)")
+	flag.Var(&flagProfileSources, "profiles.sources", "comma-separated profile files or directories; when set they replace the stored profiles and groups on start and reload")
+	flag.Var(&flagFallbackProfiles, "profiles.fallbacks", "comma-separated arch=profile pairs booting machines no group matches")
+}
+
+// stringList is a comma-separated list flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = nil
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
 }
 
 type config struct {
+	ConfigPath string
 	LogLevel   slog.Level
 	HttpAddr   string
+	AdminAddr  string
+	// MetricsAddr is empty when metrics are served on the admin listener
+	MetricsAddr string
+	HttpTLS     tlsFiles
+	AdminTLS    tlsFiles
+
+	HttpAllowedCIDRs  []string
+	AdminAllowedCIDRs []string
+
 	AssetsPath string
 	DataPath   string
 	CachePath  string
+	StatePath  string
+
+	StorageQuota  int64
+	ScrubInterval time.Duration
+
+	OTLPEndpoint    string
+	OTLPInsecure    bool
+	OTLPSampleRatio float64
+
+	MirrorURL        string
+	TrustedKeys      []string
+	FetchConcurrency int
+
+	ProfileSources []string
+	// FallbackProfiles maps normalized architectures to the profile of machines no group matches
+	FallbackProfiles map[string]string
+
+	AuthTokensFile  string
+	AuthClientCA    string
+	AuthClientRoles map[string]server.Role
+
+	SecretsDir string
+
+	URLKeyFile string
+	URLTTL     time.Duration
+	// URLBootedTTL outlasts URLTTL, as the booted system reports back only once installed
+	URLBootedTTL time.Duration
+	URLBindIP    bool
+
+	Discovery         bool
+	DiscoveryInterval time.Duration
+}
+
+// tlsFiles locates a certificate and its key. TLS is disabled when both are empty.
+type tlsFiles struct {
+	Cert string
+	Key  string
+}
+
+func (f tlsFiles) enabled() bool {
+	return f.Cert != ""
+}
+
+// fileConfig is the layout of the configuration file. Unset fields fall back to the flags.
+type fileConfig struct {
+	Log struct {
+		Level *string `yaml:"level"`
+	} `yaml:"log"`
+	Listeners struct {
+		HTTP    *string `yaml:"http"`
+		Admin   *string `yaml:"admin"`
+		Metrics *string `yaml:"metrics"`
+	} `yaml:"listeners"`
+	Allowlists struct {
+		HTTP  *[]string `yaml:"http"`
+		Admin *[]string `yaml:"admin"`
+	} `yaml:"allowlists"`
+	TLS struct {
+		HTTP  fileTLS `yaml:"http"`
+		Admin fileTLS `yaml:"admin"`
+	} `yaml:"tls"`
+	Assets struct {
+		Path *string `yaml:"path"`
+	} `yaml:"assets"`
+	Storage struct {
+		DataPath      *string        `yaml:"dataPath"`
+		CachePath     *string        `yaml:"cachePath"`
+		StatePath     *string        `yaml:"statePath"`
+		Quota         *int64         `yaml:"quota"`
+		ScrubInterval *time.Duration `yaml:"scrubInterval"`
+	} `yaml:"storage"`
+	Mirror struct {
+		URL         *string   `yaml:"url"`
+		TrustedKeys *[]string `yaml:"trustedKeys"`
+		Concurrency *int      `yaml:"concurrency"`
+	} `yaml:"mirror"`
+	Profiles struct {
+		Sources   *[]string          `yaml:"sources"`
+		Fallbacks *map[string]string `yaml:"fallbacks"`
+	} `yaml:"profiles"`
+	Auth struct {
+		TokensFile  *string                 `yaml:"tokensFile"`
+		ClientCA    *string                 `yaml:"clientCA"`
+		ClientRoles *map[string]server.Role `yaml:"clientRoles"`
+	} `yaml:"auth"`
+	Secrets struct {
+		Dir *string `yaml:"dir"`
+	} `yaml:"secrets"`
+	URLs struct {
+		SigningKeyFile *string        `yaml:"signingKeyFile"`
+		TTL            *time.Duration `yaml:"ttl"`
+		BootedTTL      *time.Duration `yaml:"bootedTTL"`
+		BindIP         *bool          `yaml:"bindIP"`
+	} `yaml:"urls"`
+	Discovery struct {
+		Enabled  *bool          `yaml:"enabled"`
+		Interval *time.Duration `yaml:"interval"`
+	} `yaml:"discovery"`
+	Tracing struct {
+		Endpoint    *string  `yaml:"endpoint"`
+		Insecure    *bool    `yaml:"insecure"`
+		SampleRatio *float64 `yaml:"sampleRatio"`
+	} `yaml:"tracing"`
 }
 
-func initConfig() config {
+type fileTLS struct {
+	Cert *string `yaml:"cert"`
+	Key  *string `yaml:"key"`
+}
+
+func loadConfigFile(path string) (fileConfig, error) {
+	var fc fileConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fc, errtrace.Wrap(err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil && err != io.EOF {
+		return fc, errtrace.Errorf("%s: %w", path, err)
+	}
+
+	// relative paths are resolved against the directory of the file
+	dir := filepath.Dir(path)
+	for _, p := range []*string{
+		fc.Assets.Path, fc.Storage.DataPath, fc.Storage.CachePath, fc.Storage.StatePath,
+		fc.TLS.HTTP.Cert, fc.TLS.HTTP.Key, fc.TLS.Admin.Cert, fc.TLS.Admin.Key,
+		fc.Auth.TokensFile, fc.Auth.ClientCA, fc.URLs.SigningKeyFile, fc.Secrets.Dir,
+	} {
+		if p != nil && *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	for _, ps := range []*[]string{fc.Mirror.TrustedKeys, fc.Profiles.Sources} {
+		if ps == nil {
+			continue
+		}
+		for i, p := range *ps {
+			if !filepath.IsAbs(p) {
+				(*ps)[i] = filepath.Join(dir, p)
+			}
+		}
+	}
+	return fc, nil
+}
+
+// initConfig merges, from lowest to highest precedence, flag defaults, the configuration file,
+// flags given on the command line and environment variables.
+func initConfig() (config, error) {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return mergeConfig(set)
+}
+
+// mergeConfig builds the configuration as initConfig does, taking the flags named in set as given on the command line.
+func mergeConfig(set map[string]bool) (config, error) {
+	configPath := os.Getenv("HOKUCHI_CONFIG")
+	if configPath == "" {
+		configPath = flagConfigPath
+	}
+	var fc fileConfig
+	if configPath != "" {
+		var err error
+		if fc, err = loadConfigFile(configPath); err != nil {
+			return config{}, errtrace.Wrap(err)
+		}
+	}
+
+	var errs []error
+
 	httpAddr := os.Getenv("HOKUCHI_HTTP_ADDRESS")
 	if httpAddr == "" {
-		httpAddr = flagHttpAddr
+		httpAddr = pick(set["http.address"], flagHttpAddr, fc.Listeners.HTTP)
 	}
 
+	adminAddr, ok := os.LookupEnv("HOKUCHI_ADMIN_ADDRESS")
+	if !ok {
+		adminAddr = pick(set["admin.address"], flagAdminAddr, fc.Listeners.Admin)
+	}
+
+	metricsAddr, ok := os.LookupEnv("HOKUCHI_METRICS_ADDRESS")
+	if !ok {
+		metricsAddr = pick(set["metrics.address"], flagMetricsAddr, fc.Listeners.Metrics)
+	}
+
+	httpTLS := tlsFiles{
+		Cert: envOr("HOKUCHI_HTTP_TLS_CERT", pick(set["http.tls.cert"], flagHttpTLSCert, fc.TLS.HTTP.Cert)),
+		Key:  envOr("HOKUCHI_HTTP_TLS_KEY", pick(set["http.tls.key"], flagHttpTLSKey, fc.TLS.HTTP.Key)),
+	}
+	adminTLS := tlsFiles{
+		Cert: envOr("HOKUCHI_ADMIN_TLS_CERT", pick(set["admin.tls.cert"], flagAdminTLSCert, fc.TLS.Admin.Cert)),
+		Key:  envOr("HOKUCHI_ADMIN_TLS_KEY", pick(set["admin.tls.key"], flagAdminTLSKey, fc.TLS.Admin.Key)),
+	}
+
+	httpAllowedCIDRs := pick(set["http.allowed-cidrs"], []string(flagHttpAllowedCIDRs), fc.Allowlists.HTTP)
+	adminAllowedCIDRs := pick(set["admin.allowed-cidrs"], []string(flagAdminAllowedCIDRs), fc.Allowlists.Admin)
+
 	logLevelStr := os.Getenv("HOKUCHI_LOG_LEVEL")
 	if logLevelStr == "" {
-		logLevelStr = flagLogLevel
+		logLevelStr = pick(set["log.level"], flagLogLevel, fc.Log.Level)
 	}
-	logLevel := new(slog.Level)
+	var logLevel slog.Level
 	if err := logLevel.UnmarshalText([]byte(logLevelStr)); err != nil {
-		fmt.Printf("cannot parse log level: %s\n", logLevelStr)
-		*logLevel = slog.LevelInfo
+		errs = append(errs, fmt.Errorf("cannot parse log level: %s", logLevelStr))
+	}
+
+	assetsPath := os.Getenv("HOKUCHI_ASSETS_PATH")
+	if assetsPath == "" {
+		assetsPath = pick(set["assets.path"], flagAssetsPath, fc.Assets.Path)
 	}
 
 	dataPath := os.Getenv("HOKUCHI_DATA_PATH")
 	if dataPath == "" {
-		dataPath = flagDataPath
+		dataPath = pick(set["data.path"], flagDataPath, fc.Storage.DataPath)
 	}
 
 	cachePath := os.Getenv("HOKUCHI_CACHE_PATH")
 	if cachePath == "" {
-		cachePath = flagCachePath
+		cachePath = pick(set["cache.path"], flagCachePath, fc.Storage.CachePath)
+	}
+
+	scrubInterval := pick(set["scrub.interval"], flagScrubInterval, fc.Storage.ScrubInterval)
+	if v := os.Getenv("HOKUCHI_SCRUB_INTERVAL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			scrubInterval = d
+		} else {
+			errs = append(errs, fmt.Errorf("cannot parse scrub interval: %s", v))
+		}
+	}
+
+	statePath := os.Getenv("HOKUCHI_STATE_PATH")
+	if statePath == "" {
+		statePath = pick(set["state.path"], flagStatePath, fc.Storage.StatePath)
+	}
+	if statePath == "" {
+		statePath = filepath.Join(dataPath, ".state.db")
+	}
+
+	storageQuota := pick(set["storage.quota"], flagStorageQuota, fc.Storage.Quota)
+	if v := os.Getenv("HOKUCHI_STORAGE_QUOTA"); v != "" {
+		if q, err := strconv.ParseInt(v, 10, 64); err == nil {
+			storageQuota = q
+		} else {
+			errs = append(errs, fmt.Errorf("cannot parse storage quota: %s", v))
+		}
+	}
+
+	otlpEndpoint := os.Getenv("HOKUCHI_OTLP_ENDPOINT")
+	if otlpEndpoint == "" {
+		otlpEndpoint = pick(set["otlp.endpoint"], flagOTLPEndpoint, fc.Tracing.Endpoint)
+	}
+
+	otlpInsecure := pick(set["otlp.insecure"], flagOTLPInsecure, fc.Tracing.Insecure)
+	if v := os.Getenv("HOKUCHI_OTLP_INSECURE"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			otlpInsecure = b
+		} else {
+			errs = append(errs, fmt.Errorf("cannot parse otlp insecure: %s", v))
+		}
+	}
+
+	otlpRatio := pick(set["otlp.sample-ratio"], flagOTLPRatio, fc.Tracing.SampleRatio)
+	if v := os.Getenv("HOKUCHI_OTLP_SAMPLE_RATIO"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			otlpRatio = f
+		} else {
+			errs = append(errs, fmt.Errorf("cannot parse otlp sample ratio: %s", v))
+		}
 	}
 
-	return config{
+	mirrorURL := os.Getenv("HOKUCHI_MIRROR_URL")
+	if mirrorURL == "" {
+		mirrorURL = pick(set["mirror.url"], flagMirrorURL, fc.Mirror.URL)
+	}
+
+	trustedKeys := pick(set["mirror.trusted-keys"], []string(flagTrustedKeys), fc.Mirror.TrustedKeys)
+
+	fetchConcurrency := pick(set["fetch.concurrency"], flagFetchConcurrency, fc.Mirror.Concurrency)
+	if v := os.Getenv("HOKUCHI_FETCH_CONCURRENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			fetchConcurrency = n
+		} else {
+			errs = append(errs, fmt.Errorf("cannot parse fetch concurrency: %s", v))
+		}
+	}
+
+	profileSources := pick(set["profiles.sources"], []string(flagProfileSources), fc.Profiles.Sources)
+
+	fallbackProfiles := make(map[string]string)
+	if set["profiles.fallbacks"] || fc.Profiles.Fallbacks == nil {
+		for _, pair := range flagFallbackProfiles {
+			arch, id, _ := strings.Cut(pair, "=")
+			if arch == "" || id == "" {
+				errs = append(errs, fmt.Errorf("cannot parse fallback profile: %s", pair))
+				continue
+			}
+			fallbackProfiles[hokuchi.NormalizeArch(arch)] = id
+		}
+	} else {
+		for arch, id := range *fc.Profiles.Fallbacks {
+			fallbackProfiles[hokuchi.NormalizeArch(arch)] = id
+		}
+	}
+
+	authTokensFile := envOr("HOKUCHI_AUTH_TOKENS_FILE", pick(set["auth.tokens-file"], flagAuthTokensFile, fc.Auth.TokensFile))
+	authClientCA := envOr("HOKUCHI_AUTH_CLIENT_CA", pick(set["auth.client-ca"], flagAuthClientCA, fc.Auth.ClientCA))
+
+	var authClientRoles map[string]server.Role
+	if set["auth.client-roles"] || fc.Auth.ClientRoles == nil {
+		authClientRoles = make(map[string]server.Role)
+		for _, pair := range flagAuthClientRoles {
+			cn, roleStr, _ := strings.Cut(pair, "=")
+			var role server.Role
+			if err := role.UnmarshalText([]byte(roleStr)); err != nil || cn == "" {
+				errs = append(errs, fmt.Errorf("cannot parse client role: %s", pair))
+				continue
+			}
+			authClientRoles[cn] = role
+		}
+	} else {
+		authClientRoles = *fc.Auth.ClientRoles
+	}
+
+	secretsDir := envOr("HOKUCHI_SECRETS_DIR", pick(set["secrets.dir"], flagSecretsDir, fc.Secrets.Dir))
+
+	urlKeyFile := envOr("HOKUCHI_URLS_SIGNING_KEY_FILE", pick(set["urls.signing-key-file"], flagURLKeyFile, fc.URLs.SigningKeyFile))
+	urlTTL := pick(set["urls.ttl"], flagURLTTL, fc.URLs.TTL)
+	if v := os.Getenv("HOKUCHI_URLS_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			urlTTL = d
+		} else {
+			errs = append(errs, fmt.Errorf("cannot parse url ttl: %s", v))
+		}
+	}
+	urlBootedTTL := pick(set["urls.booted-ttl"], flagURLBootedTTL, fc.URLs.BootedTTL)
+	if v := os.Getenv("HOKUCHI_URLS_BOOTED_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			urlBootedTTL = d
+		} else {
+			errs = append(errs, fmt.Errorf("cannot parse url booted ttl: %s", v))
+		}
+	}
+	urlBindIP := pick(set["urls.bind-ip"], flagURLBindIP, fc.URLs.BindIP)
+
+	discovery := pick(set["discovery.enabled"], flagDiscovery, fc.Discovery.Enabled)
+	if v := os.Getenv("HOKUCHI_DISCOVERY_ENABLED"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			discovery = b
+		} else {
+			errs = append(errs, fmt.Errorf("cannot parse discovery enabled: %s", v))
+		}
+	}
+	discoveryInterval := pick(set["discovery.interval"], flagDiscoveryInterval, fc.Discovery.Interval)
+
+	cfg := config{
+		ConfigPath: configPath,
 		HttpAddr:   httpAddr,
-		LogLevel:   *logLevel,
-		AssetsPath: "assets",
-		DataPath:   dataPath,
-		CachePath:  cachePath,
+		AdminAddr:  adminAddr,
+
+		MetricsAddr: metricsAddr,
+		HttpTLS:     httpTLS,
+		AdminTLS:    adminTLS,
+
+		HttpAllowedCIDRs:  httpAllowedCIDRs,
+		AdminAllowedCIDRs: adminAllowedCIDRs,
+		LogLevel:          logLevel,
+		AssetsPath:        assetsPath,
+		DataPath:          dataPath,
+		CachePath:         cachePath,
+		StatePath:         statePath,
+
+		StorageQuota:  storageQuota,
+		ScrubInterval: scrubInterval,
+
+		OTLPEndpoint:    otlpEndpoint,
+		OTLPInsecure:    otlpInsecure,
+		OTLPSampleRatio: otlpRatio,
+
+		MirrorURL:        mirrorURL,
+		TrustedKeys:      trustedKeys,
+		FetchConcurrency: fetchConcurrency,
+
+		ProfileSources:   profileSources,
+		FallbackProfiles: fallbackProfiles,
+
+		AuthTokensFile:  authTokensFile,
+		AuthClientCA:    authClientCA,
+		AuthClientRoles: authClientRoles,
+
+		SecretsDir: secretsDir,
+
+		URLKeyFile:   urlKeyFile,
+		URLTTL:       urlTTL,
+		URLBootedTTL: urlBootedTTL,
+		URLBindIP:    urlBindIP,
+
+		Discovery:         discovery,
+		DiscoveryInterval: discoveryInterval,
+	}
+	if err := cfg.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return config{}, errtrace.Wrap(errors.Join(errs...))
+	}
+	return cfg, nil
+}
+
+// pick returns the value from the configuration file unless the flag was given explicitly or the file leaves it unset.
+func pick[T any](flagSet bool, flagValue T, fileValue *T) T {
+	if flagSet || fileValue == nil {
+		return flagValue
+	}
+	return *fileValue
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func (c config) validate() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.HttpAddr); err != nil {
+		errs = append(errs, fmt.Errorf("invalid http address %q: %w", c.HttpAddr, err))
+	}
+	if c.AdminAddr != "" {
+		if _, _, err := net.SplitHostPort(c.AdminAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid admin address %q: %w", c.AdminAddr, err))
+		}
+	}
+	if c.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid metrics address %q: %w", c.MetricsAddr, err))
+		}
+	}
+	for name, files := range map[string]tlsFiles{"http": c.HttpTLS, "admin": c.AdminTLS} {
+		if (files.Cert == "") != (files.Key == "") {
+			errs = append(errs, fmt.Errorf("%s tls requires both a certificate and a key", name))
+			continue
+		}
+		for _, path := range []string{files.Cert, files.Key} {
+			if path == "" {
+				continue
+			}
+			if _, err := os.Stat(path); err != nil {
+				errs = append(errs, fmt.Errorf("%s tls: %w", name, err))
+			}
+		}
+	}
+	if c.AuthClientCA != "" && !c.AdminTLS.enabled() {
+		errs = append(errs, errors.New("auth client ca requires admin tls"))
+	}
+	for _, path := range []string{c.AuthTokensFile, c.AuthClientCA} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("auth: %w", err))
+		}
+	}
+	if c.SecretsDir != "" {
+		if info, err := os.Stat(c.SecretsDir); err != nil {
+			errs = append(errs, fmt.Errorf("secrets: %w", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("secrets: %s is not a directory", c.SecretsDir))
+		}
+	}
+	if c.URLTTL <= 0 {
+		errs = append(errs, fmt.Errorf("url ttl must be positive: %s", c.URLTTL))
+	}
+	if c.URLBootedTTL <= 0 {
+		errs = append(errs, fmt.Errorf("url booted ttl must be positive: %s", c.URLBootedTTL))
+	}
+	if c.DiscoveryInterval < time.Second {
+		errs = append(errs, fmt.Errorf("discovery interval must be at least 1s: %s", c.DiscoveryInterval))
+	}
+	if c.URLKeyFile != "" {
+		if _, err := os.Stat(c.URLKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("url signing key: %w", err))
+		}
+	}
+	for _, cidr := range append(append([]string(nil), c.HttpAllowedCIDRs...), c.AdminAllowedCIDRs...) {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			errs = append(errs, fmt.Errorf("invalid allowed cidr %q", cidr))
+		}
+	}
+	if c.DataPath == "" {
+		errs = append(errs, errors.New("data path is required"))
+	}
+	if c.StorageQuota < 0 {
+		errs = append(errs, fmt.Errorf("storage quota must not be negative: %d", c.StorageQuota))
+	}
+	if c.ScrubInterval < 0 {
+		errs = append(errs, fmt.Errorf("scrub interval must not be negative: %s", c.ScrubInterval))
+	}
+	if c.OTLPSampleRatio < 0 || c.OTLPSampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("otlp sample ratio must be between 0 and 1: %g", c.OTLPSampleRatio))
+	}
+	sampleURL := strings.NewReplacer("{channel}", "stable", "{arch}", "amd64", "{version}", "current").Replace(c.MirrorURL)
+	if u, err := url.Parse(sampleURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("invalid mirror url %q", c.MirrorURL))
+	} else if !strings.Contains(c.MirrorURL, "{version}") {
+		errs = append(errs, fmt.Errorf("mirror url %q lacks a {version} placeholder", c.MirrorURL))
+	}
+	if c.FetchConcurrency <= 0 {
+		errs = append(errs, fmt.Errorf("fetch concurrency must be positive: %d", c.FetchConcurrency))
+	}
+	for _, path := range c.TrustedKeys {
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("trusted key: %w", err))
+		}
+	}
+	for arch, id := range c.FallbackProfiles {
+		if !flatcar.IsValidArch(arch) {
+			errs = append(errs, fmt.Errorf("fallback profile %q: unsupported arch %q", id, arch))
+		}
+		if !profile.IsValidID(id) {
+			errs = append(errs, fmt.Errorf("fallback profile for %s: invalid id %q", arch, id))
+		}
+	}
+	for _, path := range c.ProfileSources {
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Errorf("profile source: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func readTrustedKeys(paths []string) ([]string, error) {
+	keys := make([]string, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errtrace.Wrap(err)
+		}
+		keys = append(keys, string(data))
 	}
+	return keys, nil
 }
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tosuke/hokuchi/flatcar"
+)
+
+// setFlag gives a flag a value for the duration of the test, as if it were on the command line.
+func setFlag(t *testing.T, set map[string]bool, name, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	old := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Value.Set(old) })
+	set[name] = true
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hokuchi.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		flags map[string]string
+		env   map[string]string
+		check func(t *testing.T, cfg config)
+	}{
+		{
+			name: "flag defaults",
+			check: func(t *testing.T, cfg config) {
+				if cfg.HttpAddr != "127.0.0.1:8080" || cfg.URLTTL != time.Hour {
+					t.Errorf("http address %q, url ttl %s", cfg.HttpAddr, cfg.URLTTL)
+				}
+			},
+		},
+		{
+			name: "file over flag defaults",
+			file: "listeners:\n  http: 0.0.0.0:80\nurls:\n  ttl: 2h\n  bootedTTL: 48h\n",
+			check: func(t *testing.T, cfg config) {
+				if cfg.HttpAddr != "0.0.0.0:80" || cfg.URLTTL != 2*time.Hour || cfg.URLBootedTTL != 48*time.Hour {
+					t.Errorf("http address %q, url ttl %s, booted %s", cfg.HttpAddr, cfg.URLTTL, cfg.URLBootedTTL)
+				}
+			},
+		},
+		{
+			name:  "flags over file",
+			file:  "listeners:\n  http: 0.0.0.0:80\nurls:\n  ttl: 2h\n",
+			flags: map[string]string{"http.address": "0.0.0.0:8000", "urls.ttl": "3h"},
+			check: func(t *testing.T, cfg config) {
+				if cfg.HttpAddr != "0.0.0.0:8000" || cfg.URLTTL != 3*time.Hour {
+					t.Errorf("http address %q, url ttl %s", cfg.HttpAddr, cfg.URLTTL)
+				}
+			},
+		},
+		{
+			name:  "environment over flags",
+			file:  "listeners:\n  http: 0.0.0.0:80\nurls:\n  ttl: 2h\n",
+			flags: map[string]string{"http.address": "0.0.0.0:8000", "urls.ttl": "3h"},
+			env:   map[string]string{"HOKUCHI_HTTP_ADDRESS": "0.0.0.0:8888", "HOKUCHI_URLS_TTL": "4h"},
+			check: func(t *testing.T, cfg config) {
+				if cfg.HttpAddr != "0.0.0.0:8888" || cfg.URLTTL != 4*time.Hour {
+					t.Errorf("http address %q, url ttl %s", cfg.HttpAddr, cfg.URLTTL)
+				}
+			},
+		},
+		{
+			name: "empty admin address from the environment",
+			env:  map[string]string{"HOKUCHI_ADMIN_ADDRESS": ""},
+			check: func(t *testing.T, cfg config) {
+				if cfg.AdminAddr != "" {
+					t.Errorf("admin address %q, want it disabled", cfg.AdminAddr)
+				}
+			},
+		},
+		{
+			name: "relative paths in the file",
+			file: "storage:\n  dataPath: data\nassets:\n  path: /srv/assets\n",
+			check: func(t *testing.T, cfg config) {
+				dir := filepath.Dir(cfg.ConfigPath)
+				if cfg.DataPath != filepath.Join(dir, "data") || cfg.AssetsPath != "/srv/assets" {
+					t.Errorf("data path %q, assets path %q", cfg.DataPath, cfg.AssetsPath)
+				}
+				if cfg.StatePath != filepath.Join(dir, "data", ".state.db") {
+					t.Errorf("state path %q", cfg.StatePath)
+				}
+			},
+		},
+		{
+			name: "fallbacks from the file",
+			file: "profiles:\n  fallbacks:\n    x86_64: web\n",
+			check: func(t *testing.T, cfg config) {
+				if len(cfg.FallbackProfiles) != 1 || cfg.FallbackProfiles["amd64"] != "web" {
+					t.Errorf("fallback profiles %v", cfg.FallbackProfiles)
+				}
+			},
+		},
+		{
+			name:  "fallbacks from flags",
+			file:  "profiles:\n  fallbacks:\n    amd64: web\n",
+			flags: map[string]string{"profiles.fallbacks": "aarch64=db"},
+			check: func(t *testing.T, cfg config) {
+				if len(cfg.FallbackProfiles) != 1 || cfg.FallbackProfiles["arm64"] != "db" {
+					t.Errorf("fallback profiles %v", cfg.FallbackProfiles)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOKUCHI_CONFIG", "")
+			if tt.file != "" {
+				t.Setenv("HOKUCHI_CONFIG", writeConfigFile(t, tt.file))
+			}
+			set := make(map[string]bool)
+			for name, value := range tt.flags {
+				setFlag(t, set, name, value)
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			cfg, err := mergeConfig(set)
+			if err != nil {
+				t.Fatalf("mergeConfig() error = %v", err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "unknown field", file: "listeners:\n  boot: 0.0.0.0:80\n", wantErr: "field boot not found"},
+		{name: "wrong type", file: "mirror:\n  concurrency: many\n", wantErr: "cannot unmarshal"},
+		{name: "invalid value", file: "mirror:\n  concurrency: 0\n", wantErr: "fetch concurrency must be positive"},
+		{name: "invalid environment", env: map[string]string{"HOKUCHI_STORAGE_QUOTA": "lots"}, wantErr: "cannot parse storage quota"},
+		{name: "invalid log level", env: map[string]string{"HOKUCHI_LOG_LEVEL": "loud"}, wantErr: "cannot parse log level"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOKUCHI_CONFIG", "")
+			if tt.file != "" {
+				t.Setenv("HOKUCHI_CONFIG", writeConfigFile(t, tt.file))
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			if _, err := mergeConfig(map[string]bool{}); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("mergeConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := config{
+		HttpAddr:          "127.0.0.1:8080",
+		AdminAddr:         "127.0.0.1:8081",
+		DataPath:          "/var/lib/hokuchi",
+		OTLPSampleRatio:   1,
+		MirrorURL:         flatcar.DefaultMirrorURL,
+		FetchConcurrency:  8,
+		URLTTL:            time.Hour,
+		URLBootedTTL:      24 * time.Hour,
+		DiscoveryInterval: 30 * time.Second,
+		FallbackProfiles:  map[string]string{"amd64": "web"},
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+
+	tests := []struct {
+		name    string
+		modify  func(c *config)
+		wantErr string
+	}{
+		{name: "valid", modify: func(c *config) {}},
+		{name: "data path", modify: func(c *config) { c.DataPath = "" }, wantErr: "data path is required"},
+		{name: "negative quota", modify: func(c *config) { c.StorageQuota = -1 }, wantErr: "storage quota must not be negative"},
+		{name: "negative scrub interval", modify: func(c *config) { c.ScrubInterval = -time.Hour }, wantErr: "scrub interval must not be negative"},
+		{name: "sample ratio", modify: func(c *config) { c.OTLPSampleRatio = 1.5 }, wantErr: "otlp sample ratio must be between 0 and 1"},
+		{name: "mirror scheme", modify: func(c *config) { c.MirrorURL = "ftp://mirror/{version}" }, wantErr: "invalid mirror url"},
+		{name: "mirror version", modify: func(c *config) { c.MirrorURL = "https://mirror/{channel}" }, wantErr: "lacks a {version} placeholder"},
+		{name: "fetch concurrency", modify: func(c *config) { c.FetchConcurrency = 0 }, wantErr: "fetch concurrency must be positive"},
+		{name: "trusted key", modify: func(c *config) { c.TrustedKeys = []string{missing} }, wantErr: "trusted key"},
+		{name: "fallback arch", modify: func(c *config) { c.FallbackProfiles = map[string]string{"sparc": "web"} }, wantErr: `unsupported arch "sparc"`},
+		{name: "fallback id", modify: func(c *config) { c.FallbackProfiles = map[string]string{"amd64": "Web Server"} }, wantErr: "invalid id"},
+		{name: "profile source", modify: func(c *config) { c.ProfileSources = []string{missing} }, wantErr: "profile source"},
+		{name: "url ttl", modify: func(c *config) { c.URLTTL = 0 }, wantErr: "url ttl must be positive"},
+		{name: "booted url ttl", modify: func(c *config) { c.URLBootedTTL = -time.Hour }, wantErr: "url booted ttl must be positive"},
+		{name: "discovery interval", modify: func(c *config) { c.DiscoveryInterval = time.Millisecond }, wantErr: "discovery interval must be at least 1s"},
+		{name: "every error", modify: func(c *config) { c.DataPath, c.FetchConcurrency = "", 0 }, wantErr: "data path is required\nfetch concurrency must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.modify(&c)
+			err := c.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigValidateListeners(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	for _, path := range []string{cert, key} {
+		if err := os.WriteFile(path, []byte("pem"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	valid := config{
+		HttpAddr:          "127.0.0.1:8080",
+		AdminAddr:         "127.0.0.1:8081",
+		DataPath:          "/var/lib/hokuchi",
+		OTLPSampleRatio:   1,
+		MirrorURL:         flatcar.DefaultMirrorURL,
+		FetchConcurrency:  8,
+		URLTTL:            time.Hour,
+		URLBootedTTL:      24 * time.Hour,
+		DiscoveryInterval: 30 * time.Second,
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(c *config)
+		wantErr string
+	}{
+		{name: "admin disabled", modify: func(c *config) { c.AdminAddr = "" }},
+		{name: "separate metrics", modify: func(c *config) { c.MetricsAddr = ":9100" }},
+		{name: "tls", modify: func(c *config) { c.HttpTLS, c.AdminTLS = tlsFiles{cert, key}, tlsFiles{cert, key} }},
+		{name: "http address", modify: func(c *config) { c.HttpAddr = "8080" }, wantErr: `invalid http address "8080"`},
+		{name: "admin address", modify: func(c *config) { c.AdminAddr = "localhost" }, wantErr: `invalid admin address "localhost"`},
+		{name: "metrics address", modify: func(c *config) { c.MetricsAddr = "::1" }, wantErr: `invalid metrics address "::1"`},
+		{name: "certificate without key", modify: func(c *config) { c.HttpTLS = tlsFiles{Cert: cert} }, wantErr: "http tls requires both a certificate and a key"},
+		{name: "key without certificate", modify: func(c *config) { c.AdminTLS = tlsFiles{Key: key} }, wantErr: "admin tls requires both a certificate and a key"},
+		{name: "missing certificate", modify: func(c *config) { c.AdminTLS = tlsFiles{filepath.Join(dir, "missing"), key} }, wantErr: "admin tls"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.modify(&c)
+			err := c.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log/slog"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi/profile"
+	"github.com/tosuke/hokuchi/secret"
+	"github.com/tosuke/hokuchi/slogerr"
+)
+
+// defaultProfileAMD64 and defaultProfileARM64 are seeded into an empty registry and
+// serve, through the default profiles.fallbacks, machines that no group matches.
+// They reference no secret, so that they boot on a fresh install. For SSH access, store the key
+// as the sshkey secret and add sshkey="${secret:sshkey}" to their args through the admin API.
+var (
+	defaultProfileAMD64 = newDefaultProfile("default-amd64", "amd64")
+	defaultProfileARM64 = newDefaultProfile("default-arm64", "arm64")
+)
+
+func newDefaultProfile(id, arch string) profile.Profile {
+	return profile.Profile{
+		ID:   id,
+		Arch: arch,
+		Boot: profile.Boot{
+			Flatcar: &profile.Flatcar{
+				Channel: "beta",
+				Version: "current",
+				Args:    []string{"flatcar.firstboot=1"},
+			},
+		},
+	}
+}
+
+func seedRegistry(r *profile.Registry) error {
+	for _, p := range []profile.Profile{defaultProfileAMD64, defaultProfileARM64} {
+		if _, err := r.CreateProfile(p); err != nil {
+			return errtrace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// legacyDefaultGroup is the catch-all group that older versions seeded, sending every machine to
+// the arm64 "default" profile. It would keep the fallback profiles from ever being used.
+const legacyDefaultGroup = "default"
+
+// migrateRegistry replaces the catch-all group seeded by older versions with the fallback profiles.
+// A group named "default" is only removed while it still is the seeded one.
+func migrateRegistry(r *profile.Registry) error {
+	g, ok := r.Group(legacyDefaultGroup)
+	if !ok || g.ProfileID != "default" || g.Selector != (profile.Selector{}) ||
+		g.Menu != nil || g.Retry != nil || len(g.AllowedCIDRs) > 0 {
+		return nil
+	}
+	for _, p := range []profile.Profile{defaultProfileAMD64, defaultProfileARM64} {
+		if _, ok := r.Profile(p.ID); ok {
+			continue
+		}
+		if _, err := r.CreateProfile(p); err != nil {
+			return errtrace.Wrap(err)
+		}
+	}
+	if err := r.DeleteGroup(g.ID, g.ResourceVersion); err != nil {
+		return errtrace.Wrap(err)
+	}
+	slog.Info("replaced the seeded catch-all group with fallback profiles", slog.String("group", g.ID))
+	return nil
+}
+
+// checkFallbacks warns about fallback profiles that cannot be used.
+func checkFallbacks(r *profile.Registry, fallbacks map[string]string, secrets *secret.Store) {
+	for arch, id := range fallbacks {
+		p, ok := r.Rendered(id)
+		if !ok {
+			slog.Warn("fallback profile does not exist", slog.String("profile", id), slog.String("arch", arch))
+			continue
+		}
+		if p.Arch != arch {
+			slog.Warn("fallback profile is built for another arch", slog.String("profile", id), slog.String("arch", arch), slog.String("profile_arch", p.Arch))
+		}
+		if fc := p.Boot.Flatcar; fc != nil {
+			if _, err := secrets.ExpandArgs(fc.Args); err != nil {
+				slog.Warn("fallback profile cannot boot until its secrets are available", slog.String("profile", id), slogerr.Err(err))
+			}
+		}
+	}
+	for _, g := range r.Groups() {
+		if g.Selector == (profile.Selector{}) {
+			slog.Warn("group matches every machine, so fallback profiles are never used", slog.String("group", g.ID))
+		}
+	}
+}
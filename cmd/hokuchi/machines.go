@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tosuke/hokuchi/inventory"
+)
+
+func runMachines(args []string) int {
+	fs := flag.NewFlagSet("machines", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: hokuchi machines [flags] [id]")
+		fs.PrintDefaults()
+	}
+	client := newAdminClientFlags(fs)
+	status := fs.String("status", "", "list only machines with this status, such as pending")
+	fs.Parse(args)
+
+	if id := fs.Arg(0); id != "" {
+		var m inventory.Machine
+		if err := client.do("GET", "/api/v1/machines/"+url.PathEscape(id), nil, &m); err != nil {
+			return printErr(err)
+		}
+		printMachines([]inventory.Machine{m})
+		return 0
+	}
+
+	path := "/api/v1/machines"
+	if *status != "" {
+		path += "?" + url.Values{"status": {*status}}.Encode()
+	}
+	var ms []inventory.Machine
+	if err := client.do("GET", path, nil, &ms); err != nil {
+		return printErr(err)
+	}
+	printMachines(ms)
+	return 0
+}
+
+func runRearm(args []string) int {
+	fs := flag.NewFlagSet("rearm", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: hokuchi rearm [flags] id")
+		fmt.Fprintln(fs.Output(), "Lets a machine retrieve its one-time ignition config again.")
+		fs.PrintDefaults()
+	}
+	client := newAdminClientFlags(fs)
+	fs.Parse(args)
+
+	id := fs.Arg(0)
+	if id == "" {
+		fs.Usage()
+		return 2
+	}
+	if err := client.do("POST", "/api/v1/machines/"+url.PathEscape(id)+"/rearm", nil, nil); err != nil {
+		return printErr(err)
+	}
+	fmt.Printf("re-armed %s\n", id)
+	return 0
+}
+
+func runApprove(args []string) int {
+	fs := flag.NewFlagSet("approve", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: hokuchi approve [flags] id")
+		fmt.Fprintln(fs.Output(), "Lets a machine held in discovery mode boot.")
+		fs.PrintDefaults()
+	}
+	client := newAdminClientFlags(fs)
+	profileID := fs.String("profile", "", "assign this profile instead of letting groups choose")
+	unassign := fs.Bool("unassign", false, "remove the assigned profile and let groups choose")
+	fs.Parse(args)
+
+	id := fs.Arg(0)
+	if id == "" {
+		fs.Usage()
+		return 2
+	}
+	var m inventory.Machine
+	if err := client.do("POST", "/api/v1/machines/"+url.PathEscape(id)+"/approve", map[string]any{"profileId": *profileID, "unassign": *unassign}, &m); err != nil {
+		return printErr(err)
+	}
+	printMachines([]inventory.Machine{m})
+	return 0
+}
+
+func printMachines(ms []inventory.Machine) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tMAC\tUUID\tHOSTNAME\tARCH\tSTATUS\tPROFILE\tBOOTS\tSOURCE IP\tLAST SEEN")
+	for _, m := range ms {
+		status, profileID := m.Status, m.ProfileID
+		if status == "" {
+			status = "-"
+		}
+		if m.AssignedProfileID != "" {
+			profileID = m.AssignedProfileID + " (assigned)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			m.ID, m.MAC, m.UUID, m.Hostname, m.Arch, status, profileID, m.BootAttempts, m.SourceIP, m.LastSeen.Format(time.RFC3339))
+	}
+	tw.Flush()
+}
@@ -11,9 +11,15 @@ import (
 
 	"braces.dev/errtrace"
 	"github.com/tosuke/hokuchi/flatcar"
+	"github.com/tosuke/hokuchi/inventory"
+	"github.com/tosuke/hokuchi/metrics"
+	"github.com/tosuke/hokuchi/profile"
+	"github.com/tosuke/hokuchi/secret"
 	"github.com/tosuke/hokuchi/server"
 	"github.com/tosuke/hokuchi/slogerr"
+	"github.com/tosuke/hokuchi/state"
 	"github.com/tosuke/hokuchi/storage"
+	"github.com/tosuke/hokuchi/tracing"
 )
 
 func main() {
@@ -24,45 +30,211 @@ func main() {
 }
 
 func run(args []string) int {
+	if len(args) > 1 {
+		if cmd, ok := commands[args[1]]; ok {
+			return cmd(args[2:])
+		}
+	}
+
 	flag.CommandLine.Parse(args[1:])
 	if flagHelp {
 		flag.Usage()
 		return 0
 	}
 
-	cfg := initConfig()
+	cfg, err := initConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		return 2
+	}
 
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(cfg.LogLevel)
 	h := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		AddSource: false,
-		Level:     cfg.LogLevel,
+		Level:     logLevel,
 	})
-	logger := slog.New(h)
+	logger := slog.New(tracing.NewLogHandler(h))
 	slog.SetDefault(logger)
 
-	storage := storage.NewFSStorage(cfg.DataPath, cfg.CachePath)
-	defer storage.Close()
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Option{
+		Endpoint:    cfg.OTLPEndpoint,
+		Insecure:    cfg.OTLPInsecure,
+		SampleRatio: cfg.OTLPSampleRatio,
+	})
+	if err != nil {
+		slog.Error("Error setting up tracing", slogerr.Err(err))
+		return 1
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Error flushing traces", slogerr.Err(err))
+		}
+	}()
+
+	var srv *server.Server
+	store, err := storage.NewFSStorage(storage.FSOption{
+		DataDir: cfg.DataPath,
+		TempDir: cfg.CachePath,
+		Quota:   cfg.StorageQuota,
+		Pinned: func() []string {
+			return srv.PinnedArtifacts()
+		},
+	})
+	if err != nil {
+		slog.Error("Error opening storage", slogerr.Err(err))
+		return 1
+	}
+	defer store.Close()
+
+	db, err := state.Open(cfg.StatePath)
+	if err != nil {
+		slog.Error("Error opening state database", slogerr.Err(err))
+		return 1
+	}
+	defer db.Close()
+
+	profiles, err := profile.OpenRegistry(db)
+	if err != nil {
+		slog.Error("Error loading profiles", slogerr.Err(err))
+		return 1
+	}
+	if len(cfg.ProfileSources) > 0 {
+		if err := loadProfileSources(profiles, cfg.ProfileSources); err != nil {
+			slog.Error("Error loading profile sources", slogerr.Err(err))
+			return 1
+		}
+	} else if profiles.Empty() {
+		if err := seedRegistry(profiles); err != nil {
+			slog.Error("Error seeding profiles", slogerr.Err(err))
+			return 1
+		}
+	} else if err := migrateRegistry(profiles); err != nil {
+		slog.Error("Error migrating profiles", slogerr.Err(err))
+		return 1
+	}
+	secrets := &secret.Store{Dir: cfg.SecretsDir}
+	checkFallbacks(profiles, cfg.FallbackProfiles, secrets)
 
-	server := &server.Server{
+	trustedKeys, err := readTrustedKeys(cfg.TrustedKeys)
+	if err != nil {
+		slog.Error("Error reading trusted keys", slogerr.Err(err))
+		return 1
+	}
+	fetcher, err := flatcar.New(flatcar.Option{
+		RequestConcurrency: cfg.FetchConcurrency,
+		MirrorURL:          cfg.MirrorURL,
+		TrustedKeys:        trustedKeys,
+	})
+	if err != nil {
+		slog.Error("Error creating flatcar fetcher", slogerr.Err(err))
+		return 1
+	}
+
+	tokens, err := loadTokens(cfg.AuthTokensFile)
+	if err != nil {
+		slog.Error("Error loading admin API tokens", slogerr.Err(err))
+		return 1
+	}
+	auth := server.NewAuthenticator(tokens, cfg.AuthClientRoles)
+	if len(tokens) == 0 && cfg.AuthClientCA == "" {
+		slog.Warn("no admin API credentials configured; every admin API request will be rejected")
+	}
+
+	signingKey, err := loadSigningKey(cfg.URLKeyFile)
+	if err != nil {
+		slog.Error("Error loading URL signing key", slogerr.Err(err))
+		return 1
+	}
+	if cfg.URLKeyFile == "" {
+		slog.Warn("no URL signing key file configured; signed URLs handed out before a restart will be rejected after it, including those of machines still installing")
+	}
+
+	mtr := metrics.New()
+	mtr.RegisterStorage(store)
+
+	srv = &server.Server{
 		Logger:     logger,
 		AssetsPath: cfg.AssetsPath,
 
-		Flatcar: flatcar.New(flatcar.Option{
-			RequestConcurrency: 8,
-		}),
-		Storage: storage,
+		Flatcar:   fetcher,
+		Storage:   store,
+		Profiles:  profiles,
+		Inventory: inventory.New(db),
+		Metrics:   mtr,
+		Auth:      auth,
+		Secrets:   secrets,
+		Signer: &server.URLSigner{
+			Key:       signingKey,
+			TTL:       cfg.URLTTL,
+			BootedTTL: cfg.URLBootedTTL,
+			BindIP:    cfg.URLBindIP,
+		},
+
+		FallbackProfiles:  cfg.FallbackProfiles,
+		Discovery:         cfg.Discovery,
+		DiscoveryInterval: cfg.DiscoveryInterval,
+		SeparateMetrics:   cfg.MetricsAddr != "",
+		BootAllowedCIDRs:  cfg.HttpAllowedCIDRs,
+		AdminAllowedCIDRs: cfg.AdminAllowedCIDRs,
 	}
-	defer server.Close()
+	defer srv.Close()
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 	ctx, cancel := context.WithCancelCause(ctx)
 	defer cancel(nil)
 
-	slog.Info(fmt.Sprintf("starting HTTP server on %s", cfg.HttpAddr))
+	scrubber := &storage.Scrubber{
+		Storage:         store,
+		Interval:        cfg.ScrubInterval,
+		VerifySignature: fetcher.VerifySignature,
+		OnCorrupt: func(ctx context.Context, key string) {
+			srv.Prefetch(ctx)
+		},
+	}
+	mtr.RegisterScrubber(scrubber)
+	go scrubber.Run(ctx)
+
+	go watchReload(ctx, cfg, logLevel, profiles, auth)
+
+	bootListener, err := newListener(ctx, cfg.HttpAddr, cfg.HttpTLS)
+	if err != nil {
+		slog.Error("Error setting up HTTP listener", slogerr.Err(err))
+		return 1
+	}
+	slog.Info(fmt.Sprintf("starting HTTP server on %s", cfg.HttpAddr), slog.Bool("tls", cfg.HttpTLS.enabled()))
 	go func() {
-		err := server.Start(cfg.HttpAddr)
+		err := srv.Start(bootListener)
 		cancel(errtrace.Wrap(err))
 	}()
+	if cfg.AdminAddr != "" {
+		adminListener, err := newListener(ctx, cfg.AdminAddr, cfg.AdminTLS)
+		if err != nil {
+			slog.Error("Error setting up admin listener", slogerr.Err(err))
+			return 1
+		}
+		if cfg.AuthClientCA != "" {
+			if err := requireClientCerts(adminListener.TLS, cfg.AuthClientCA); err != nil {
+				slog.Error("Error loading admin API client CA", slogerr.Err(err))
+				return 1
+			}
+		}
+		slog.Info(fmt.Sprintf("starting admin API server on %s", cfg.AdminAddr), slog.Bool("tls", cfg.AdminTLS.enabled()))
+		go func() {
+			err := srv.StartAdmin(adminListener)
+			cancel(errtrace.Wrap(err))
+		}()
+	}
+	if cfg.MetricsAddr != "" {
+		slog.Info(fmt.Sprintf("starting metrics server on %s", cfg.MetricsAddr))
+		go func() {
+			err := srv.StartMetrics(server.Listener{Addr: cfg.MetricsAddr})
+			cancel(errtrace.Wrap(err))
+		}()
+	}
 
 	<-ctx.Done()
 	if err := context.Cause(ctx); err != nil && err != context.Canceled {
@@ -74,10 +246,28 @@ func run(args []string) int {
 	slog.Info("shutting down gracefully")
 	gracefulCtx, stop := context.WithTimeout(context.Background(), 5*time.Second)
 	defer stop()
-	if err := server.Shutdown(gracefulCtx); err != nil {
+	if err := srv.Shutdown(gracefulCtx); err != nil {
 		slog.Error("Error shutting down", slogerr.Err(err))
 		return 1
 	}
 
 	return 0
 }
+
+// certReloadInterval is how often certificate files are checked for replacement.
+const certReloadInterval = 30 * time.Second
+
+// newListener enables TLS when files are configured and keeps the certificate up to date until ctx is done.
+func newListener(ctx context.Context, addr string, files tlsFiles) (server.Listener, error) {
+	l := server.Listener{Addr: addr}
+	if !files.enabled() {
+		return l, nil
+	}
+	cr, err := server.NewCertReloader(files.Cert, files.Key)
+	if err != nil {
+		return server.Listener{}, errtrace.Wrap(err)
+	}
+	go cr.Run(ctx, certReloadInterval)
+	l.TLS = cr.TLSConfig()
+	return l, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi/profile"
+	"github.com/tosuke/hokuchi/server"
+	"github.com/tosuke/hokuchi/slogerr"
+)
+
+// loadProfileSources replaces the registry with the profiles and groups read from sources,
+// and makes it refuse writes through the admin API, which the next load would undo.
+func loadProfileSources(r *profile.Registry, sources []string) error {
+	profiles, groups, err := profile.LoadSources(sources)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	if err := r.Replace(profiles, groups); err != nil {
+		return errtrace.Wrap(err)
+	}
+	r.SetManaged(true)
+	return nil
+}
+
+// watchReload re-reads the configuration on SIGHUP. The log level, profile sources and admin API
+// credentials take effect immediately; an invalid configuration is rejected as a whole and the running one is kept.
+func watchReload(ctx context.Context, cfg config, logLevel *slog.LevelVar, profiles *profile.Registry, auth *server.Authenticator) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		slog.InfoContext(ctx, "reloading configuration")
+		next, err := initConfig()
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reloading configuration", slogerr.Err(err))
+			continue
+		}
+		tokens, err := loadTokens(next.AuthTokensFile)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reloading admin API tokens", slogerr.Err(err))
+			continue
+		}
+		if len(next.ProfileSources) > 0 {
+			if err := loadProfileSources(profiles, next.ProfileSources); err != nil {
+				slog.ErrorContext(ctx, "Error reloading profile sources", slogerr.Err(err))
+				continue
+			}
+		} else {
+			// the profiles loaded last stay, now open to the admin API
+			profiles.SetManaged(false)
+		}
+		auth.SetTokens(tokens)
+		auth.SetClientRoles(next.AuthClientRoles)
+		logLevel.Set(next.LogLevel)
+
+		restart := next
+		restart.LogLevel, restart.ProfileSources = cfg.LogLevel, cfg.ProfileSources
+		restart.AuthTokensFile, restart.AuthClientRoles = cfg.AuthTokensFile, cfg.AuthClientRoles
+		if !reflect.DeepEqual(restart, cfg) {
+			slog.WarnContext(ctx, "configuration changes other than log level, profile sources and admin API credentials take effect on restart")
+		}
+		cfg.LogLevel, cfg.ProfileSources = next.LogLevel, next.ProfileSources
+		cfg.AuthTokensFile, cfg.AuthClientRoles = next.AuthTokensFile, next.AuthClientRoles
+		slog.InfoContext(ctx, "reloaded configuration")
+	}
+}
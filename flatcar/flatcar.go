@@ -13,19 +13,43 @@ import (
 	"braces.dev/errtrace"
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	"github.com/tosuke/hokuchi"
+	"github.com/tosuke/hokuchi/syncmap"
+	"github.com/tosuke/hokuchi/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
+var tracer = otel.Tracer("github.com/tosuke/hokuchi/flatcar")
+
+var ErrBadSignature = errtrace.New("flatcar: bad signature")
+
+// DefaultMirrorURL is the official Flatcar release server.
+const DefaultMirrorURL = "https://{channel}.release.flatcar-linux.net/{arch}-usr/{version}"
+
 type Fetcher struct {
-	http *http.Client
-	sema chan struct{}
+	http      *http.Client
+	sema      chan struct{}
+	mirrorURL string
+	keyring   *crypto.KeyRing
+
+	// versions holds the last version resolved for each "current" key
+	versions syncmap.M[Key, string]
 }
 type Option struct {
 	RequestConcurrency int
-	HTTP *http.Client
+	HTTP               *http.Client
+	// MirrorURL is the base URL of a release, with {channel}, {arch} and {version} placeholders.
+	// It defaults to DefaultMirrorURL.
+	MirrorURL string
+	// TrustedKeys are armored public keys accepted for release signatures.
+	// The Flatcar image signing key is used when empty.
+	TrustedKeys []string
 }
 
-func New(option Option) *Fetcher {
+func New(option Option) (*Fetcher, error) {
 	var sema chan struct{}
 	if option.RequestConcurrency > 0 {
 		sema = make(chan struct{}, option.RequestConcurrency)
@@ -36,13 +60,39 @@ func New(option Option) *Fetcher {
 		hc = option.HTTP
 	}
 
-	return &Fetcher{
-		http: hc,
-		sema: sema,
+	mirrorURL := option.MirrorURL
+	if mirrorURL == "" {
+		mirrorURL = DefaultMirrorURL
+	}
+
+	keys := option.TrustedKeys
+	if len(keys) == 0 {
+		keys = []string{flatcarGPGKey}
+	}
+	keyring, err := keyringFromArmored(keys...)
+	if err != nil {
+		return nil, errtrace.Wrap(err)
 	}
+
+	return &Fetcher{
+		http:      hc,
+		sema:      sema,
+		mirrorURL: mirrorURL,
+		keyring:   keyring,
+	}, nil
 }
 
-func (f *Fetcher) ResolveKey(ctx context.Context, channel, arch, version string) (Key, error) {
+func (f *Fetcher) ResolveKey(ctx context.Context, channel, arch, version string) (_ Key, err error) {
+	ctx, span := tracer.Start(ctx, "flatcar.ResolveKey", trace.WithAttributes(
+		attribute.String("flatcar.channel", channel),
+		attribute.String("flatcar.arch", arch),
+		attribute.String("flatcar.version", version),
+	))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
 	k := Key{
 		channel: channel,
 		arch:    hokuchi.NormalizeArch(arch),
@@ -56,7 +106,7 @@ func (f *Fetcher) ResolveKey(ctx context.Context, channel, arch, version string)
 		return Key{}, errtrace.New("invalid arch")
 	}
 	if k.version == "current" {
-		currentVer, err := f.fetchVersion(ctx, k)
+		currentVer, err := f.currentVersion(ctx, k)
 		if err != nil {
 			return Key{}, errtrace.Wrap(err)
 		}
@@ -73,6 +123,45 @@ func (f *Fetcher) FetchKernel(ctx context.Context, w io.Writer, key Key) error {
 	return f.fetchKernel(ctx, w, key)
 }
 
+func (f *Fetcher) FetchInitrd(ctx context.Context, w io.Writer, key Key) error {
+	return f.fetchInitrd(ctx, w, key)
+}
+
+func (f *Fetcher) currentVersion(ctx context.Context, key Key) (string, error) {
+	version, err := f.fetchVersion(ctx, key)
+	if err != nil {
+		return "", errtrace.Wrap(err)
+	}
+	f.versions.Store(key, version)
+	return version, nil
+}
+
+// LastVersion returns the last "current" version resolved for channel and arch.
+func (f *Fetcher) LastVersion(channel, arch string) (string, bool) {
+	return f.versions.Load(Key{channel: channel, arch: hokuchi.NormalizeArch(arch), version: "current"})
+}
+
+// KnownKey returns the key of a release without contacting the mirror.
+// A "current" version is only known once it has been resolved by ResolveKey.
+func (f *Fetcher) KnownKey(channel, arch, version string) (Key, bool) {
+	if version == "current" {
+		v, ok := f.LastVersion(channel, arch)
+		if !ok {
+			return Key{}, false
+		}
+		version = v
+	}
+	k := Key{
+		channel: channel,
+		arch:    hokuchi.NormalizeArch(arch),
+		version: version,
+	}
+	if !IsValidChannel(k.channel) || !IsValidArch(k.arch) || !IsValidVersion(k.version) {
+		return Key{}, false
+	}
+	return k, true
+}
+
 func (f *Fetcher) fetchVersion(ctx context.Context, key Key) (string, error) {
 	var versionBuf bytes.Buffer
 	var versionSigBuf bytes.Buffer
@@ -97,8 +186,8 @@ func (f *Fetcher) fetchVersion(ctx context.Context, key Key) (string, error) {
 	message := crypto.NewPlainMessage(versionBuf.Bytes())
 	signature := crypto.NewPGPSignature(versionSigBuf.Bytes())
 
-	if err := signKeyring.VerifyDetached(message, signature, crypto.GetUnixTime()); err != nil {
-		return "", errtrace.Wrap(err)
+	if err := f.keyring.VerifyDetached(message, signature, crypto.GetUnixTime()); err != nil {
+		return "", errtrace.Errorf("%w: %w", ErrBadSignature, err)
 	}
 
 	sc := bufio.NewScanner(&versionBuf)
@@ -112,28 +201,68 @@ func (f *Fetcher) fetchVersion(ctx context.Context, key Key) (string, error) {
 	return "", errtrace.New("failed to find version")
 }
 
+// SignatureSetter is implemented by writers that keep the detached signature of the data written to them.
+type SignatureSetter interface {
+	SetSignature(sig []byte)
+}
+
+// SizeReserver is implemented by writers that make room for the data before it is written to them.
+type SizeReserver interface {
+	Reserve(size int64) error
+}
+
+// VerifySignature checks data previously fetched from the Flatcar mirror against its detached signature.
+func (f *Fetcher) VerifySignature(r io.Reader, sig []byte) error {
+	signature := crypto.NewPGPSignature(sig)
+	if err := f.keyring.VerifyDetachedStream(r, signature, crypto.GetUnixTime()); err != nil {
+		return errtrace.Errorf("%w: %w", ErrBadSignature, err)
+	}
+	return nil
+}
+
 func (f *Fetcher) fetchKernel(ctx context.Context, w io.Writer, key Key) error {
+	return f.fetchVerified(ctx, w, key, "/flatcar_production_pxe.vmlinuz")
+}
+
+func (f *Fetcher) fetchInitrd(ctx context.Context, w io.Writer, key Key) error {
+	return f.fetchVerified(ctx, w, key, "/flatcar_production_pxe_image.cpio.gz")
+}
+
+// fetchVerified streams subpath into w while checking its detached signature.
+// w receives the data before the signature is checked, so callers must discard it when an error is returned.
+func (f *Fetcher) fetchVerified(ctx context.Context, w io.Writer, key Key, subpath string) error {
 	eg, ectx := errgroup.WithContext(ctx)
 	pr, pw := io.Pipe()
 
 	eg.Go(func() error {
-		writer := io.MultiWriter(w, pw)
-		defer pw.Close()
-		if err := f.fetchData(ectx, writer, key, "/flatcar_production_pxe.vmlinuz", 0); err != nil {
+		var writer io.Writer = io.MultiWriter(w, pw)
+		if sr, ok := w.(SizeReserver); ok {
+			writer = struct {
+				io.Writer
+				SizeReserver
+			}{writer, sr}
+		}
+		if err := f.fetchData(ectx, writer, key, subpath, 0); err != nil {
+			pw.CloseWithError(err)
 			return errtrace.Wrap(err)
 		}
+		pw.Close()
 		return nil
 	})
 	eg.Go(func() error {
-
-		var kernelSigBuf bytes.Buffer
-		if err := f.fetchData(ctx, &kernelSigBuf, key, "/flatcar_production_pxe.vmlinuz.sig", 2048); err != nil {
+		var sigBuf bytes.Buffer
+		if err := f.fetchData(ectx, &sigBuf, key, subpath+".sig", 2048); err != nil {
+			pr.CloseWithError(err)
 			return errtrace.Wrap(err)
 		}
-		signature := crypto.NewPGPSignature(kernelSigBuf.Bytes())
+		signature := crypto.NewPGPSignature(sigBuf.Bytes())
 
-		if err := signKeyring.VerifyDetachedStream(pr, signature, crypto.GetUnixTime()); err != nil {
-			return errtrace.Wrap(err)
+		if err := f.keyring.VerifyDetachedStream(pr, signature, crypto.GetUnixTime()); err != nil {
+			pr.CloseWithError(err)
+			return errtrace.Errorf("%w: %w", ErrBadSignature, err)
+		}
+		if ss, ok := w.(SignatureSetter); ok {
+			ss.SetSignature(sigBuf.Bytes())
 		}
 		return nil
 	})
@@ -145,8 +274,17 @@ func (f *Fetcher) fetchKernel(ctx context.Context, w io.Writer, key Key) error {
 	return nil
 }
 
-func (f *Fetcher) fetchData(ctx context.Context, w io.Writer, key Key, subpath string, limit int64) error {
-	url := key.baseURL() + subpath
+func (f *Fetcher) fetchData(ctx context.Context, w io.Writer, key Key, subpath string, limit int64) (err error) {
+	url := key.baseURL(f.mirrorURL) + subpath
+	ctx, span := tracer.Start(ctx, "flatcar.fetch", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.HTTPMethod("GET"),
+		semconv.URLFull(url),
+	))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return errtrace.Wrap(err)
@@ -170,10 +308,17 @@ func (f *Fetcher) fetchData(ctx context.Context, w io.Writer, key Key, subpath s
 	}()
 
 	slog.DebugContext(ctx, "processing response", slog.String("url", url))
+	span.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
 	if resp.StatusCode != http.StatusOK {
 		return errtrace.Errorf("invalid status from flatcar: %d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
 	}
 
+	if sr, ok := w.(SizeReserver); ok && resp.ContentLength >= 0 {
+		if err := sr.Reserve(resp.ContentLength); err != nil {
+			return errtrace.Wrap(err)
+		}
+	}
+
 	var r io.Reader = resp.Body
 	if limit > 0 {
 		r = io.LimitReader(r, limit)
@@ -187,16 +332,19 @@ func (f *Fetcher) fetchData(ctx context.Context, w io.Writer, key Key, subpath s
 //go:embed Flatcar_Image_Signing_key.asc
 var flatcarGPGKey string
 
-var signKeyring *crypto.KeyRing = mustKeyringFromArmored(flatcarGPGKey)
-
-func mustKeyringFromArmored(pubKey string) *crypto.KeyRing {
-	pubKeyObj, err := crypto.NewKeyFromArmored(pubKey)
+func keyringFromArmored(pubKeys ...string) (*crypto.KeyRing, error) {
+	keyring, err := crypto.NewKeyRing(nil)
 	if err != nil {
-		panic(err)
+		return nil, errtrace.Wrap(err)
 	}
-	keyring, err := crypto.NewKeyRing(pubKeyObj)
-	if err != nil {
-		panic(err)
+	for _, pubKey := range pubKeys {
+		pubKeyObj, err := crypto.NewKeyFromArmored(pubKey)
+		if err != nil {
+			return nil, errtrace.Errorf("invalid trusted key: %w", err)
+		}
+		if err := keyring.AddKey(pubKeyObj); err != nil {
+			return nil, errtrace.Wrap(err)
+		}
 	}
-	return keyring
+	return keyring, nil
 }
@@ -3,6 +3,7 @@ package flatcar
 import (
 	"fmt"
 	"regexp"
+	"strings"
 )
 
 type Key struct {
@@ -38,8 +39,8 @@ func IsValidVersion(version string) bool {
 func (k Key) String() string {
 	return fmt.Sprintf("flatcar-%s-%s-%s", k.channel, k.arch, k.version)
 }
-func (k Key) baseURL() string {
-	return fmt.Sprintf("https://%s.release.flatcar-linux.net/%s-usr/%s", k.channel, k.arch, k.version)
+func (k Key) baseURL(mirrorURL string) string {
+	return strings.NewReplacer("{channel}", k.channel, "{arch}", k.arch, "{version}", k.version).Replace(mirrorURL)
 }
 func (k Key) valid() bool {
 	return IsValidChannel(k.channel) && IsValidArch(k.arch) && IsValidVersion(k.version)
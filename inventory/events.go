@@ -0,0 +1,95 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi/state"
+)
+
+type EventType string
+
+// Boot lifecycle events, in the order a successful boot emits them.
+const (
+	EventIPXE     EventType = "ipxe"
+	EventKernel   EventType = "kernel"
+	EventInitrd   EventType = "initrd"
+	EventIgnition EventType = "ignition"
+	EventBooted   EventType = "booted"
+)
+
+// maxEventsPerMachine bounds the history kept for each machine; older events are dropped.
+const maxEventsPerMachine = 200
+
+type Event struct {
+	MachineID string    `json:"machineId"`
+	Type      EventType `json:"type"`
+	Time      time.Time `json:"time"`
+	ProfileID string    `json:"profileId,omitempty"`
+	SourceIP  string    `json:"sourceIP,omitempty"`
+	// Error is set when the step failed.
+	Error string `json:"error,omitempty"`
+}
+
+func eventKey(machineID string, seq uint64) string {
+	return fmt.Sprintf("%s/%020d", machineID, seq)
+}
+
+// RecordEvent appends an event to the history of a known machine.
+func (inv *Inventory) RecordEvent(ctx context.Context, e Event) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	err := inv.db.Update(func(tx *state.Tx) error {
+		var m Machine
+		if err := tx.Get(state.BucketMachines, e.MachineID, &m); err != nil {
+			if errors.Is(err, state.ErrNotFound) {
+				return errtrace.Wrap(ErrNotFound)
+			}
+			return errtrace.Wrap(err)
+		}
+
+		seq, err := tx.NextSequence(state.BucketEvents)
+		if err != nil {
+			return errtrace.Wrap(err)
+		}
+		if err := tx.Put(state.BucketEvents, eventKey(e.MachineID, seq), e); err != nil {
+			return errtrace.Wrap(err)
+		}
+
+		var keys []string
+		if err := state.ForEachPrefix(tx, state.BucketEvents, e.MachineID+"/", func(key string, _ Event) error {
+			keys = append(keys, key)
+			return nil
+		}); err != nil {
+			return errtrace.Wrap(err)
+		}
+		for len(keys) > maxEventsPerMachine {
+			if err := tx.Delete(state.BucketEvents, keys[0]); err != nil {
+				return errtrace.Wrap(err)
+			}
+			keys = keys[1:]
+		}
+		return nil
+	})
+	return errtrace.Wrap(err)
+}
+
+// Events returns the history of a machine, oldest first.
+func (inv *Inventory) Events(ctx context.Context, machineID string) ([]Event, error) {
+	events := []Event{}
+	err := inv.db.View(func(tx *state.Tx) error {
+		return state.ForEachPrefix(tx, state.BucketEvents, machineID+"/", func(_ string, e Event) error {
+			events = append(events, e)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	return events, nil
+}
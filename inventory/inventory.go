@@ -0,0 +1,182 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi/profile"
+	"github.com/tosuke/hokuchi/state"
+)
+
+var ErrNotFound = errtrace.New("inventory: machine not found")
+
+// Machine is the inventory record of a machine that chained to hokuchi.
+type Machine struct {
+	ID string `json:"id"`
+	profile.Machine
+
+	FirstSeen    time.Time `json:"firstSeen"`
+	LastSeen     time.Time `json:"lastSeen"`
+	SourceIP     string    `json:"sourceIP"`
+	ProfileID    string    `json:"profileId,omitempty"`
+	BootAttempts int       `json:"bootAttempts"`
+	// RetryAttempt is the number of retries of the current boot so far.
+	RetryAttempt int `json:"retryAttempt"`
+	// Status is StatusPending until an operator approves a machine discovered in discovery mode.
+	// Machines first seen outside discovery mode have no status and are treated as approved.
+	Status string `json:"status,omitempty"`
+	// AssignedProfileID is the profile an operator assigned, overriding group matching.
+	AssignedProfileID string `json:"assignedProfileId,omitempty"`
+}
+
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+)
+
+func (m Machine) Pending() bool {
+	return m.Status == StatusPending
+}
+
+// Sighting is a single request from a machine.
+type Sighting struct {
+	Machine   profile.Machine
+	SourceIP  string
+	ProfileID string
+	// NewBoot is set for the first request of a boot, as opposed to retries.
+	NewBoot bool
+	// Attempt is the retry attempt the request belongs to, zero for the first request.
+	Attempt int
+	// Discovery records a machine seen for the first time as pending approval.
+	Discovery bool
+}
+
+type Inventory struct {
+	db *state.DB
+	// serializes read-modify-write of records
+	mu sync.Mutex
+}
+
+func New(db *state.DB) *Inventory {
+	return &Inventory{db: db}
+}
+
+// MachineID derives a stable identifier from the MAC address, or the SMBIOS UUID when the MAC is unknown.
+// It returns an empty string when the machine cannot be identified.
+func MachineID(m profile.Machine) string {
+	if mac := profile.NormalizeMAC(m.MAC); mac != "" {
+		return strings.ReplaceAll(mac, ":", "-")
+	}
+	if m.UUID != "" {
+		return strings.ToLower(m.UUID)
+	}
+	return ""
+}
+
+func (inv *Inventory) Record(ctx context.Context, s Sighting) (Machine, error) {
+	id := MachineID(s.Machine)
+	if id == "" {
+		return Machine{}, errtrace.New("inventory: machine has no identifier")
+	}
+	now := time.Now()
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	var m Machine
+	err := inv.db.Update(func(tx *state.Tx) error {
+		if err := tx.Get(state.BucketMachines, id, &m); err != nil {
+			if !errors.Is(err, state.ErrNotFound) {
+				return errtrace.Wrap(err)
+			}
+			m = Machine{ID: id, FirstSeen: now}
+			if s.Discovery {
+				m.Status = StatusPending
+			}
+		}
+		m.Machine = s.Machine
+		m.LastSeen = now
+		m.SourceIP = s.SourceIP
+		if s.ProfileID != "" {
+			m.ProfileID = s.ProfileID
+		}
+		if s.NewBoot {
+			m.BootAttempts++
+		}
+		m.RetryAttempt = s.Attempt
+		return tx.Put(state.BucketMachines, id, m)
+	})
+	if err != nil {
+		return Machine{}, errtrace.Wrap(err)
+	}
+	return m, nil
+}
+
+func (inv *Inventory) Get(ctx context.Context, id string) (Machine, error) {
+	var m Machine
+	err := inv.db.View(func(tx *state.Tx) error {
+		return tx.Get(state.BucketMachines, id, &m)
+	})
+	if err != nil {
+		if errors.Is(err, state.ErrNotFound) {
+			return Machine{}, errtrace.Wrap(ErrNotFound)
+		}
+		return Machine{}, errtrace.Wrap(err)
+	}
+	return m, nil
+}
+
+func (inv *Inventory) List(ctx context.Context) ([]Machine, error) {
+	var ms []Machine
+	err := inv.db.View(func(tx *state.Tx) error {
+		return state.ForEach(tx, state.BucketMachines, func(_ string, m Machine) error {
+			ms = append(ms, m)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	return ms, nil
+}
+
+// Assignment tells Approve what to do with the profile assigned to a machine.
+// The zero value keeps the current assignment.
+type Assignment struct {
+	// ProfileID assigns the machine a profile.
+	ProfileID string
+	// Clear removes the assignment, leaving the choice to the groups.
+	Clear bool
+}
+
+// Approve lets a pending machine boot and changes its assigned profile as a tells.
+func (inv *Inventory) Approve(ctx context.Context, id string, a Assignment) (Machine, error) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	var m Machine
+	err := inv.db.Update(func(tx *state.Tx) error {
+		if err := tx.Get(state.BucketMachines, id, &m); err != nil {
+			if errors.Is(err, state.ErrNotFound) {
+				return errtrace.Wrap(ErrNotFound)
+			}
+			return errtrace.Wrap(err)
+		}
+		m.Status = StatusApproved
+		switch {
+		case a.ProfileID != "":
+			m.AssignedProfileID = a.ProfileID
+		case a.Clear:
+			m.AssignedProfileID = ""
+		}
+		return tx.Put(state.BucketMachines, id, m)
+	})
+	if err != nil {
+		return Machine{}, errtrace.Wrap(err)
+	}
+	return m, nil
+}
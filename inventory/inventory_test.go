@@ -0,0 +1,37 @@
+package inventory
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tosuke/hokuchi/profile"
+)
+
+func TestApproveAssignment(t *testing.T) {
+	ctx := context.Background()
+	inv := newTestInventory(t)
+	m, err := inv.Record(ctx, Sighting{Machine: profile.Machine{MAC: "52:54:00:00:00:01"}, NewBoot: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name       string
+		assignment Assignment
+		want       string
+	}{
+		{name: "assign", assignment: Assignment{ProfileID: "web"}, want: "web"},
+		{name: "keep", assignment: Assignment{}, want: "web"},
+		{name: "reassign", assignment: Assignment{ProfileID: "db"}, want: "db"},
+		{name: "clear", assignment: Assignment{Clear: true}, want: ""},
+	}
+	for _, step := range steps {
+		got, err := inv.Approve(ctx, m.ID, step.assignment)
+		if err != nil {
+			t.Fatalf("%s: Approve() error = %v", step.name, err)
+		}
+		if got.Status != StatusApproved || got.AssignedProfileID != step.want {
+			t.Fatalf("%s: Approve() = %+v, want profile %q", step.name, got, step.want)
+		}
+	}
+}
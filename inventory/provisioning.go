@@ -0,0 +1,130 @@
+package inventory
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi/state"
+)
+
+var (
+	ErrTokenInvalid  = errtrace.New("inventory: provisioning token invalid")
+	ErrTokenConsumed = errtrace.New("inventory: provisioning token already consumed")
+)
+
+// Provisioning tracks the one-time ignition token of a machine.
+// Only a digest of the token is kept.
+type Provisioning struct {
+	MachineID  string     `json:"machineId"`
+	ProfileID  string     `json:"profileId"`
+	TokenHash  string     `json:"tokenHash,omitempty"`
+	IssuedAt   time.Time  `json:"issuedAt"`
+	ConsumedAt *time.Time `json:"consumedAt,omitempty"`
+}
+
+func (p Provisioning) Consumed() bool {
+	return p.ConsumedAt != nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// MintToken issues a new token for the machine, replacing any unconsumed one.
+// Once a token has been consumed, no more are issued until the machine is re-armed.
+func (inv *Inventory) MintToken(ctx context.Context, machineID, profileID string) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", errtrace.Wrap(err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	err := inv.db.Update(func(tx *state.Tx) error {
+		var p Provisioning
+		if err := tx.Get(state.BucketProvisioning, machineID, &p); err == nil {
+			if p.Consumed() {
+				return errtrace.Wrap(ErrTokenConsumed)
+			}
+		} else if !errors.Is(err, state.ErrNotFound) {
+			return errtrace.Wrap(err)
+		}
+		return tx.Put(state.BucketProvisioning, machineID, Provisioning{
+			MachineID: machineID,
+			ProfileID: profileID,
+			TokenHash: hashToken(token),
+			IssuedAt:  time.Now(),
+		})
+	})
+	if err != nil {
+		return "", errtrace.Wrap(err)
+	}
+	return token, nil
+}
+
+// ConsumeToken marks the machine's token as used if token matches it.
+func (inv *Inventory) ConsumeToken(ctx context.Context, machineID, token string) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	return errtrace.Wrap(inv.db.Update(func(tx *state.Tx) error {
+		var p Provisioning
+		if err := tx.Get(state.BucketProvisioning, machineID, &p); err != nil {
+			if errors.Is(err, state.ErrNotFound) {
+				return errtrace.Wrap(ErrTokenInvalid)
+			}
+			return errtrace.Wrap(err)
+		}
+		if p.Consumed() {
+			return errtrace.Wrap(ErrTokenConsumed)
+		}
+		if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(p.TokenHash)) != 1 {
+			return errtrace.Wrap(ErrTokenInvalid)
+		}
+		now := time.Now()
+		p.ConsumedAt = &now
+		return tx.Put(state.BucketProvisioning, machineID, p)
+	}))
+}
+
+// Provisioning returns the token state of a machine.
+func (inv *Inventory) Provisioning(ctx context.Context, machineID string) (Provisioning, error) {
+	var p Provisioning
+	err := inv.db.View(func(tx *state.Tx) error {
+		return tx.Get(state.BucketProvisioning, machineID, &p)
+	})
+	if err != nil {
+		if errors.Is(err, state.ErrNotFound) {
+			return Provisioning{}, errtrace.Wrap(ErrNotFound)
+		}
+		return Provisioning{}, errtrace.Wrap(err)
+	}
+	return p, nil
+}
+
+// Rearm lets a machine retrieve its ignition config once more.
+func (inv *Inventory) Rearm(ctx context.Context, machineID string) error {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	return errtrace.Wrap(inv.db.Update(func(tx *state.Tx) error {
+		var m Machine
+		if err := tx.Get(state.BucketMachines, machineID, &m); err != nil {
+			if errors.Is(err, state.ErrNotFound) {
+				return errtrace.Wrap(ErrNotFound)
+			}
+			return errtrace.Wrap(err)
+		}
+		return tx.Delete(state.BucketProvisioning, machineID)
+	}))
+}
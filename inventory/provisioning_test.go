@@ -0,0 +1,86 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/tosuke/hokuchi/profile"
+	"github.com/tosuke/hokuchi/state"
+)
+
+func newTestInventory(t *testing.T) *Inventory {
+	t.Helper()
+	db, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return New(db)
+}
+
+func TestProvisioningToken(t *testing.T) {
+	ctx := context.Background()
+	inv := newTestInventory(t)
+	m, err := inv.Record(ctx, Sighting{Machine: profile.Machine{MAC: "52:54:00:00:00:01"}, NewBoot: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := inv.ConsumeToken(ctx, m.ID, "nothing-minted"); !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("ConsumeToken() before minting: error = %v, want %v", err, ErrTokenInvalid)
+	}
+
+	first, err := inv.MintToken(ctx, m.ID, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a new boot script replaces the token it was given before
+	second, err := inv.MintToken(ctx, m.ID, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("MintToken() issued the same token twice")
+	}
+	if err := inv.ConsumeToken(ctx, m.ID, first); !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("ConsumeToken() with a replaced token: error = %v, want %v", err, ErrTokenInvalid)
+	}
+	if err := inv.ConsumeToken(ctx, m.ID, second); err != nil {
+		t.Fatalf("ConsumeToken() error = %v", err)
+	}
+
+	p, err := inv.Provisioning(ctx, m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Consumed() || p.ProfileID != "web" || p.TokenHash == second {
+		t.Errorf("Provisioning() = %+v", p)
+	}
+
+	if err := inv.ConsumeToken(ctx, m.ID, second); !errors.Is(err, ErrTokenConsumed) {
+		t.Fatalf("ConsumeToken() twice: error = %v, want %v", err, ErrTokenConsumed)
+	}
+	if _, err := inv.MintToken(ctx, m.ID, "web"); !errors.Is(err, ErrTokenConsumed) {
+		t.Fatalf("MintToken() after consuming: error = %v, want %v", err, ErrTokenConsumed)
+	}
+
+	if err := inv.Rearm(ctx, m.ID); err != nil {
+		t.Fatal(err)
+	}
+	third, err := inv.MintToken(ctx, m.ID, "web")
+	if err != nil {
+		t.Fatalf("MintToken() after re-arming: error = %v", err)
+	}
+	if err := inv.ConsumeToken(ctx, m.ID, third); err != nil {
+		t.Fatalf("ConsumeToken() after re-arming: error = %v", err)
+	}
+}
+
+func TestRearmUnknownMachine(t *testing.T) {
+	inv := newTestInventory(t)
+	if err := inv.Rearm(context.Background(), "52-54-00-00-00-09"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Rearm() error = %v, want %v", err, ErrNotFound)
+	}
+}
@@ -0,0 +1,212 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tosuke/hokuchi/storage"
+)
+
+const namespace = "hokuchi"
+
+// Metrics holds the collectors hokuchi exports. A nil *Metrics discards all observations.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests        *prometheus.CounterVec
+	httpRequestDuration *prometheus.HistogramVec
+	artifactBytes       *prometheus.CounterVec
+	fetchDuration       *prometheus.HistogramVec
+	fetchFailures       *prometheus.CounterVec
+	signatureFailures   prometheus.Counter
+	fetchesInFlight     prometheus.Gauge
+	ipxeRetries         prometheus.Counter
+	ipxeRetryAttempt    prometheus.Histogram
+	ipxeRetryExhausted  prometheus.Counter
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "HTTP request latency by route and method.",
+			Buckets:   []float64{.005, .01, .05, .1, .5, 1, 5, 10, 30, 60, 300},
+		}, []string{"route", "method"}),
+		artifactBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "artifact_bytes_served_total",
+			Help:      "Bytes of boot artifacts written to clients.",
+		}, []string{"artifact"}),
+		fetchDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "flatcar_fetch_duration_seconds",
+			Help:      "Duration of Flatcar artifact downloads into storage.",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+		}, []string{"artifact"}),
+		fetchFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "flatcar_fetch_failures_total",
+			Help:      "Failed Flatcar artifact downloads.",
+		}, []string{"artifact"}),
+		signatureFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "signature_verification_failures_total",
+			Help:      "Downloads rejected because their signature did not verify.",
+		}),
+		fetchesInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "storage_writes_in_flight",
+			Help:      "Artifacts currently being written to storage.",
+		}),
+		ipxeRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ipxe_retries_total",
+			Help:      "Retry scripts rendered by the iPXE handler.",
+		}),
+		ipxeRetryAttempt: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "ipxe_retry_attempt",
+			Help:      "Attempt number of rendered retry scripts.",
+			Buckets:   []float64{1, 2, 3, 5, 8, 13, 21},
+		}),
+		ipxeRetryExhausted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "ipxe_retries_exhausted_total",
+			Help:      "Boots given up after reaching the maximum attempt count.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpRequestDuration,
+		m.artifactBytes,
+		m.fetchDuration,
+		m.fetchFailures,
+		m.signatureFailures,
+		m.fetchesInFlight,
+		m.ipxeRetries,
+		m.ipxeRetryAttempt,
+		m.ipxeRetryExhausted,
+	)
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// RegisterStorage exports the usage of s.
+func (m *Metrics) RegisterStorage(s storage.Storage) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "storage_used_bytes",
+			Help:      "Bytes of artifacts in storage.",
+		}, func() float64 {
+			used, _ := s.Usage(context.Background())
+			return float64(used)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "storage_quota_bytes",
+			Help:      "Configured storage quota in bytes, 0 when unlimited.",
+		}, func() float64 {
+			_, quota := s.Usage(context.Background())
+			return float64(quota)
+		}),
+	)
+}
+
+// RegisterScrubber exports the results of storage integrity checks.
+func (m *Metrics) RegisterScrubber(sc *storage.Scrubber) {
+	counter := func(name, help string, value func(storage.ScrubStats) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, func() float64 {
+			return float64(value(sc.Stats()))
+		})
+	}
+	m.registry.MustRegister(
+		counter("scrub_runs_total", "Completed storage scrub runs.", func(s storage.ScrubStats) uint64 { return s.Runs }),
+		counter("scrub_checked_total", "Blobs checked by the scrubber.", func(s storage.ScrubStats) uint64 { return s.Checked }),
+		counter("scrub_corrupted_total", "Corrupted blobs found by the scrubber.", func(s storage.ScrubStats) uint64 { return s.Corrupted }),
+		counter("scrub_failed_total", "Blobs the scrubber failed to check.", func(s storage.ScrubStats) uint64 { return s.Failed }),
+	)
+}
+
+func (m *Metrics) ObserveRequest(route, method string, code int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	if route == "" {
+		route = "unmatched"
+	}
+	m.httpRequests.WithLabelValues(route, method, strconv.Itoa(code)).Inc()
+	m.httpRequestDuration.WithLabelValues(route, method).Observe(d.Seconds())
+}
+
+func (m *Metrics) AddArtifactBytes(artifact string, n int64) {
+	if m == nil {
+		return
+	}
+	m.artifactBytes.WithLabelValues(artifact).Add(float64(n))
+}
+
+// FetchStarted records the start of a download and returns a function that records its end.
+func (m *Metrics) FetchStarted(artifact string) func(err error, badSignature bool) {
+	if m == nil {
+		return func(error, bool) {}
+	}
+	start := time.Now()
+	m.fetchesInFlight.Inc()
+	return func(err error, badSignature bool) {
+		m.fetchesInFlight.Dec()
+		if err != nil {
+			m.fetchFailures.WithLabelValues(artifact).Inc()
+			if badSignature {
+				m.signatureFailures.Inc()
+			}
+			return
+		}
+		m.fetchDuration.WithLabelValues(artifact).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *Metrics) SignatureFailure() {
+	if m == nil {
+		return
+	}
+	m.signatureFailures.Inc()
+}
+
+func (m *Metrics) IPXERetry(attempt int) {
+	if m == nil {
+		return
+	}
+	m.ipxeRetries.Inc()
+	m.ipxeRetryAttempt.Observe(float64(attempt))
+}
+
+func (m *Metrics) IPXERetryExhausted() {
+	if m == nil {
+		return
+	}
+	m.ipxeRetryExhausted.Inc()
+}
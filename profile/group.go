@@ -0,0 +1,190 @@
+package profile
+
+import (
+	"slices"
+	"strings"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi"
+)
+
+// Group assigns a profile to the machines matching its selector.
+type Group struct {
+	ID              string   `json:"id"`
+	ResourceVersion int64    `json:"resourceVersion,omitempty"`
+	ProfileID       string   `json:"profileId"`
+	Selector        Selector `json:"selector"`
+	// AllowedCIDRs restricts which client addresses may boot through the group. Empty allows any.
+	AllowedCIDRs []string `json:"allowedCIDRs,omitempty"`
+	// Menu lets an operator at the console pick the profile to boot instead.
+	Menu *Menu `json:"menu,omitempty"`
+	// Retry controls how machines wait for the artifacts of their profile. Nil uses DefaultRetry.
+	Retry *RetryPolicy `json:"retry,omitempty"`
+}
+
+// What a machine does once it has used up its attempts.
+const (
+	RetryExhaustedShell = "shell"
+	RetryExhaustedExit  = "exit"
+)
+
+// RetryPolicy is an exponential backoff with equal jitter between boot attempts.
+type RetryPolicy struct {
+	BaseSeconds int `json:"baseSeconds,omitempty"`
+	CapSeconds  int `json:"capSeconds,omitempty"`
+	// MaxAttempts is the number of retries before giving up. Zero retries forever.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// OnExhausted is RetryExhaustedShell, the default, to drop to the iPXE shell,
+	// or RetryExhaustedExit to exit to the next boot device.
+	OnExhausted string `json:"onExhausted,omitempty"`
+}
+
+// MaxRetrySeconds bounds the base and cap of a RetryPolicy.
+const MaxRetrySeconds = 24 * 60 * 60
+
+// DefaultRetry is the policy of groups that do not set one.
+var DefaultRetry = RetryPolicy{BaseSeconds: 10, CapSeconds: 600}
+
+// RetryPolicy returns the group's policy with unset fields taken from DefaultRetry.
+func (g Group) RetryPolicy() RetryPolicy {
+	p := DefaultRetry
+	if r := g.Retry; r != nil {
+		p.MaxAttempts = r.MaxAttempts
+		p.OnExhausted = r.OnExhausted
+		if r.BaseSeconds != 0 {
+			p.BaseSeconds = r.BaseSeconds
+		}
+		if r.CapSeconds != 0 {
+			p.CapSeconds = r.CapSeconds
+		}
+	}
+	if p.OnExhausted == "" {
+		p.OnExhausted = RetryExhaustedShell
+	}
+	return p
+}
+
+// DefaultMenuTimeout is how long a boot menu waits for a choice when Menu.TimeoutSeconds is zero.
+const DefaultMenuTimeout = 10
+
+// Menu offers a choice of profiles at boot. The group's own profile is the default
+// and is chosen when the timeout expires.
+type Menu struct {
+	// ProfileIDs lists the other profiles to offer, in order.
+	ProfileIDs     []string `json:"profileIds"`
+	TimeoutSeconds int      `json:"timeoutSeconds,omitempty"`
+}
+
+// Timeout returns the number of seconds the menu waits for a choice.
+func (m Menu) Timeout() int {
+	if m.TimeoutSeconds == 0 {
+		return DefaultMenuTimeout
+	}
+	return m.TimeoutSeconds
+}
+
+// ProfileIDs returns the profiles the group may boot, its default one first.
+func (g Group) ProfileIDs() []string {
+	ids := []string{g.ProfileID}
+	if g.Menu != nil {
+		for _, id := range g.Menu.ProfileIDs {
+			if !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// Selector matches machines by their identifiers. Empty fields match anything.
+type Selector struct {
+	UUID     string `json:"uuid,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+	Serial   string `json:"serial,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Arch     string `json:"arch,omitempty"`
+}
+
+// Machine holds the identifiers a machine reports when it chains to hokuchi.
+type Machine struct {
+	UUID     string `json:"uuid,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+	Serial   string `json:"serial,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Arch     string `json:"arch,omitempty"`
+}
+
+// NormalizeMAC converts a MAC address to lower-case, colon-separated form.
+func NormalizeMAC(mac string) string {
+	return strings.ToLower(strings.ReplaceAll(mac, "-", ":"))
+}
+
+func (g Group) Validate() error {
+	if !IsValidID(g.ID) {
+		return errtrace.Errorf("%w: invalid id %q", ErrInvalid, g.ID)
+	}
+	if !IsValidID(g.ProfileID) {
+		return errtrace.Errorf("%w: invalid profile id %q", ErrInvalid, g.ProfileID)
+	}
+	if err := validateCIDRs(g.AllowedCIDRs); err != nil {
+		return errtrace.Wrap(err)
+	}
+	if m := g.Menu; m != nil {
+		for _, id := range m.ProfileIDs {
+			if !IsValidID(id) {
+				return errtrace.Errorf("%w: invalid menu profile id %q", ErrInvalid, id)
+			}
+		}
+		if m.TimeoutSeconds < 0 {
+			return errtrace.Errorf("%w: negative menu timeout", ErrInvalid)
+		}
+	}
+	if r := g.Retry; r != nil {
+		if r.BaseSeconds < 0 || r.CapSeconds < 0 || r.MaxAttempts < 0 {
+			return errtrace.Errorf("%w: negative retry setting", ErrInvalid)
+		}
+		if r.BaseSeconds > MaxRetrySeconds || r.CapSeconds > MaxRetrySeconds {
+			return errtrace.Errorf("%w: retry base and cap must not exceed %d seconds", ErrInvalid, MaxRetrySeconds)
+		}
+		if p := g.RetryPolicy(); p.CapSeconds < p.BaseSeconds {
+			return errtrace.Errorf("%w: retry cap is below its base", ErrInvalid)
+		}
+		switch r.OnExhausted {
+		case "", RetryExhaustedShell, RetryExhaustedExit:
+		default:
+			return errtrace.Errorf("%w: unknown retry onExhausted %q", ErrInvalid, r.OnExhausted)
+		}
+	}
+	return nil
+}
+
+func (s Selector) Matches(m Machine) bool {
+	if s.UUID != "" && !strings.EqualFold(s.UUID, m.UUID) {
+		return false
+	}
+	if s.MAC != "" && NormalizeMAC(s.MAC) != NormalizeMAC(m.MAC) {
+		return false
+	}
+	if s.Serial != "" && s.Serial != m.Serial {
+		return false
+	}
+	if s.Hostname != "" && s.Hostname != m.Hostname {
+		return false
+	}
+	if s.Arch != "" && hokuchi.NormalizeArch(s.Arch) != hokuchi.NormalizeArch(m.Arch) {
+		return false
+	}
+	return true
+}
+
+// specificity counts the constrained fields, so that the most specific group wins.
+func (s Selector) specificity() int {
+	n := 0
+	for _, f := range []string{s.UUID, s.MAC, s.Serial, s.Hostname, s.Arch} {
+		if f != "" {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,31 @@
+package profile
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGroupValidateRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		retry   RetryPolicy
+		wantErr bool
+	}{
+		{name: "defaults", retry: RetryPolicy{}},
+		{name: "bounded", retry: RetryPolicy{BaseSeconds: 1, CapSeconds: MaxRetrySeconds, MaxAttempts: 5, OnExhausted: RetryExhaustedExit}},
+		{name: "negative", retry: RetryPolicy{BaseSeconds: -1}, wantErr: true},
+		{name: "cap too large", retry: RetryPolicy{CapSeconds: MaxRetrySeconds + 1}, wantErr: true},
+		{name: "base too large", retry: RetryPolicy{BaseSeconds: 1 << 62, CapSeconds: MaxRetrySeconds}, wantErr: true},
+		{name: "cap below base", retry: RetryPolicy{BaseSeconds: 60, CapSeconds: 30}, wantErr: true},
+		{name: "unknown exhaustion", retry: RetryPolicy{OnExhausted: "reboot"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retry := tt.retry
+			err := Group{ID: "all", ProfileID: "web", Retry: &retry}.Validate()
+			if tt.wantErr != errors.Is(err, ErrInvalid) || (!tt.wantErr && err != nil) {
+				t.Errorf("Validate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
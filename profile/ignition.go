@@ -0,0 +1,215 @@
+package profile
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+
+	"braces.dev/errtrace"
+)
+
+// DefaultIgnitionVersion is the spec version of composed configs whose parts do not state one.
+const DefaultIgnitionVersion = "3.3.0"
+
+// ignitionListKeys names the fields identifying the entries of keyed lists in an Ignition config,
+// by their path in the config. Entries of these lists with equal keys are merged rather than repeated.
+var ignitionListKeys = map[string][]string{
+	"ignition.config.merge":                        {"source"},
+	"ignition.security.tls.certificateAuthorities": {"source"},
+	"storage.disks":                                {"device"},
+	"storage.disks.partitions":                     {"number", "label"},
+	"storage.raid":                                 {"name"},
+	"storage.filesystems":                          {"device"},
+	"storage.luks":                                 {"name"},
+	"storage.files":                                {"path"},
+	"storage.directories":                          {"path"},
+	"storage.links":                                {"path"},
+	"systemd.units":                                {"name"},
+	"systemd.units.dropins":                        {"name"},
+	"passwd.users":                                 {"name"},
+	"passwd.groups":                                {"name"},
+}
+
+// MergeIgnition merges the Ignition config child into parent the way Ignition merges configs:
+// objects are merged recursively with child values replacing parent ones, entries of keyed lists
+// such as files and units are merged with the parent entry of the same path or name, and other
+// lists are appended to, leaving out values the parent already has.
+func MergeIgnition(parent, child string) (string, error) {
+	var p, c map[string]any
+	if err := json.Unmarshal([]byte(parent), &p); err != nil {
+		return "", errtrace.Errorf("%w: parent ignition config: %w", ErrInvalid, err)
+	}
+	if err := json.Unmarshal([]byte(child), &c); err != nil {
+		return "", errtrace.Errorf("%w: ignition config: %w", ErrInvalid, err)
+	}
+	merged, err := json.Marshal(mergeObjects("", p, c))
+	if err != nil {
+		return "", errtrace.Wrap(err)
+	}
+	return string(merged), nil
+}
+
+func mergeObjects(path string, parent, child map[string]any) map[string]any {
+	out := make(map[string]any, len(parent)+len(child))
+	for k, v := range parent {
+		out[k] = v
+	}
+	for k, cv := range child {
+		out[k] = mergeValues(joinPath(path, k), out[k], cv)
+	}
+	return out
+}
+
+func mergeValues(path string, parent, child any) any {
+	switch c := child.(type) {
+	case map[string]any:
+		if p, ok := parent.(map[string]any); ok {
+			return mergeObjects(path, p, c)
+		}
+	case []any:
+		if p, ok := parent.([]any); ok {
+			return mergeLists(path, p, c)
+		}
+	}
+	return child
+}
+
+func mergeLists(path string, parent, child []any) []any {
+	out := slices.Clone(parent)
+	keys := ignitionListKeys[path]
+	for _, cv := range child {
+		i := -1
+		if len(keys) > 0 {
+			if k, ok := entryKey(cv, keys); ok {
+				i = slices.IndexFunc(out, func(pv any) bool {
+					pk, ok := entryKey(pv, keys)
+					return ok && pk == k
+				})
+			}
+			if i >= 0 {
+				out[i] = mergeValues(path, out[i], cv)
+				continue
+			}
+		} else if slices.ContainsFunc(out, func(pv any) bool { return equalPrimitive(pv, cv) }) {
+			continue
+		}
+		out = append(out, cv)
+	}
+	return out
+}
+
+// entryKey returns the value of the first of keys set on a list entry.
+func entryKey(entry any, keys []string) (any, bool) {
+	obj, ok := entry.(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	for _, k := range keys {
+		if v, ok := obj[k]; ok && v != nil && v != "" && v != float64(0) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func equalPrimitive(a, b any) bool {
+	switch a.(type) {
+	case map[string]any, []any:
+		return false
+	}
+	switch b.(type) {
+	case map[string]any, []any:
+		return false
+	}
+	return a == b
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// ComposeIgnition merges fragments in order on top of base, which may be empty, into one config.
+// The result states DefaultIgnitionVersion unless one of its parts states a version.
+func ComposeIgnition(base string, fragments []string) (string, error) {
+	doc := base
+	if doc == "" {
+		doc = "{}"
+	}
+	for _, f := range fragments {
+		merged, err := MergeIgnition(doc, f)
+		if err != nil {
+			return "", errtrace.Wrap(err)
+		}
+		doc = merged
+	}
+
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(doc), &obj); err != nil {
+		return "", errtrace.Errorf("%w: ignition config: %w", ErrInvalid, err)
+	}
+	ign, _ := obj["ignition"].(map[string]any)
+	if ign == nil {
+		ign = make(map[string]any)
+		obj["ignition"] = ign
+	}
+	if _, ok := ign["version"]; !ok {
+		ign["version"] = DefaultIgnitionVersion
+	}
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return "", errtrace.Wrap(err)
+	}
+	return string(out), nil
+}
+
+func (ign Ignition) validateFragments() error {
+	if len(ign.Fragments) == 0 {
+		return nil
+	}
+	if ign.Source != "" {
+		return errtrace.Errorf("%w: ignition source and fragments are exclusive", ErrInvalid)
+	}
+	if ign.Inline != "" {
+		if err := validateIgnitionJSON(ign.Inline); err != nil {
+			return errtrace.Errorf("%w: ignition inline: %w", ErrInvalid, err)
+		}
+	}
+	for i, f := range ign.Fragments {
+		name := f.Name
+		if name == "" {
+			name = "#" + strconv.Itoa(i)
+		}
+		switch {
+		case (f.Inline == "") == (f.Source == ""):
+			return errtrace.Errorf("%w: ignition fragment %s needs exactly one of inline and source", ErrInvalid, name)
+		case f.Inline != "":
+			if err := validateIgnitionJSON(f.Inline); err != nil {
+				return errtrace.Errorf("%w: ignition fragment %s: %w", ErrInvalid, name, err)
+			}
+		case !strings.HasPrefix(f.Source, "http://") && !strings.HasPrefix(f.Source, "https://"):
+			return errtrace.Errorf("%w: ignition fragment %s: source must be an http or https url", ErrInvalid, name)
+		}
+	}
+	return nil
+}
+
+// validateIgnitionJSON checks that a config can be merged: it must be a JSON object
+// and, if it states a spec version, a version of Ignition v3.
+func validateIgnitionJSON(config string) error {
+	var obj map[string]any
+	if err := json.Unmarshal([]byte(config), &obj); err != nil {
+		return errtrace.Wrap(err)
+	}
+	if ign, ok := obj["ignition"].(map[string]any); ok {
+		if v, ok := ign["version"]; ok {
+			if s, ok := v.(string); !ok || !strings.HasPrefix(s, "3.") {
+				return errtrace.Errorf("unsupported ignition version %v", v)
+			}
+		}
+	}
+	return nil
+}
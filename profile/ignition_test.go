@@ -0,0 +1,125 @@
+package profile
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMergeIgnition(t *testing.T) {
+	tests := []struct {
+		name    string
+		parent  string
+		child   string
+		want    string
+		wantErr error
+	}{
+		{
+			name:   "child values replace parent ones",
+			parent: `{"ignition":{"version":"3.3.0"},"storage":{"files":[]}}`,
+			child:  `{"ignition":{"version":"3.4.0"}}`,
+			want:   `{"ignition":{"version":"3.4.0"},"storage":{"files":[]}}`,
+		},
+		{
+			name:   "keyed entries are merged by path",
+			parent: `{"storage":{"files":[{"path":"/etc/a","mode":420},{"path":"/etc/b"}]}}`,
+			child:  `{"storage":{"files":[{"path":"/etc/a","mode":384},{"path":"/etc/c"}]}}`,
+			want:   `{"storage":{"files":[{"path":"/etc/a","mode":384},{"path":"/etc/b"},{"path":"/etc/c"}]}}`,
+		},
+		{
+			name:   "nested keyed lists are merged",
+			parent: `{"systemd":{"units":[{"name":"a.service","dropins":[{"name":"10.conf","contents":"x"}]}]}}`,
+			child:  `{"systemd":{"units":[{"name":"a.service","enabled":true,"dropins":[{"name":"10.conf","contents":"y"},{"name":"20.conf"}]}]}}`,
+			want:   `{"systemd":{"units":[{"name":"a.service","enabled":true,"dropins":[{"name":"10.conf","contents":"y"},{"name":"20.conf"}]}]}}`,
+		},
+		{
+			name:   "partitions are keyed by number, then label",
+			parent: `{"storage":{"disks":[{"device":"/dev/sda","partitions":[{"number":1,"sizeMiB":10},{"label":"root"}]}]}}`,
+			child:  `{"storage":{"disks":[{"device":"/dev/sda","partitions":[{"number":1,"sizeMiB":20},{"label":"root","sizeMiB":0}]}]}}`,
+			want:   `{"storage":{"disks":[{"device":"/dev/sda","partitions":[{"number":1,"sizeMiB":20},{"label":"root","sizeMiB":0}]}]}}`,
+		},
+		{
+			name:   "unkeyed lists are appended without duplicates",
+			parent: `{"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["a","b"]}]}}`,
+			child:  `{"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["b","c"]}]}}`,
+			want:   `{"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["a","b","c"]}]}}`,
+		},
+		{
+			name:   "entries without a key are appended",
+			parent: `{"storage":{"files":[{"path":"/etc/a"}]}}`,
+			child:  `{"storage":{"files":[{"mode":420}]}}`,
+			want:   `{"storage":{"files":[{"path":"/etc/a"},{"mode":420}]}}`,
+		},
+		{
+			name:    "invalid parent",
+			parent:  `{`,
+			child:   `{}`,
+			wantErr: ErrInvalid,
+		},
+		{
+			name:    "invalid child",
+			parent:  `{}`,
+			child:   `[]`,
+			wantErr: ErrInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MergeIgnition(tt.parent, tt.child)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("MergeIgnition() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MergeIgnition() error = %v", err)
+			}
+			assertJSONEqual(t, got, tt.want)
+		})
+	}
+}
+
+func TestComposeIgnition(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      string
+		fragments []string
+		want      string
+	}{
+		{
+			name: "empty base gets the default version",
+			want: `{"ignition":{"version":"` + DefaultIgnitionVersion + `"}}`,
+		},
+		{
+			name:      "fragments are merged in order",
+			base:      `{"storage":{"files":[{"path":"/etc/a","contents":{"source":"data:,1"}}]}}`,
+			fragments: []string{`{"storage":{"files":[{"path":"/etc/a","contents":{"source":"data:,2"}}]}}`, `{"ignition":{"version":"3.4.0"}}`},
+			want:      `{"ignition":{"version":"3.4.0"},"storage":{"files":[{"path":"/etc/a","contents":{"source":"data:,2"}}]}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ComposeIgnition(tt.base, tt.fragments)
+			if err != nil {
+				t.Fatalf("ComposeIgnition() error = %v", err)
+			}
+			assertJSONEqual(t, got, tt.want)
+		})
+	}
+}
+
+func assertJSONEqual(t *testing.T, got, want string) {
+	t.Helper()
+	var g, w any
+	if err := json.Unmarshal([]byte(got), &g); err != nil {
+		t.Fatalf("invalid JSON %s: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("invalid JSON %s: %v", want, err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
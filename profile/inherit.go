@@ -0,0 +1,109 @@
+package profile
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"braces.dev/errtrace"
+)
+
+// Inherit returns child with what it leaves unset taken from parent. Labels are merged,
+// child kernel args follow those of the parent, inline Ignition configs are merged
+// with MergeIgnition and child fragments follow those of the parent. An ignition source
+// is opaque, so a child may replace it but not extend it. The result no longer extends anything.
+func Inherit(parent, child Profile) (Profile, error) {
+	out := child
+	out.Extends = ""
+	if out.Arch == "" {
+		out.Arch = parent.Arch
+	}
+	if len(parent.Labels) > 0 {
+		out.Labels = maps.Clone(parent.Labels)
+		maps.Copy(out.Labels, child.Labels)
+	}
+	if len(out.AllowedCIDRs) == 0 {
+		out.AllowedCIDRs = parent.AllowedCIDRs
+	}
+
+	switch pfc, cfc := parent.Boot.Flatcar, child.Boot.Flatcar; {
+	case cfc == nil:
+		out.Boot.Flatcar = pfc
+	case pfc != nil:
+		fc := *cfc
+		if fc.Channel == "" {
+			fc.Channel = pfc.Channel
+		}
+		if fc.Version == "" {
+			fc.Version = pfc.Version
+		}
+		fc.Args = append(slices.Clone(pfc.Args), cfc.Args...)
+		out.Boot.Flatcar = &fc
+	}
+
+	pign, cign := parent.Ignition, child.Ignition
+	switch {
+	case cign.Source != "":
+	case cign.Inline == "" && len(cign.Fragments) == 0:
+		out.Ignition = pign
+	case pign.Source != "":
+		return Profile{}, errtrace.Errorf("%w: profile %q: inline ignition cannot extend the ignition source of %q", ErrInvalid, child.ID, parent.ID)
+	case len(pign.Fragments) > 0 && cign.Inline != "":
+		// the child's config goes on top of the parent's fragments
+		out.Ignition.Inline = pign.Inline
+		out.Ignition.Fragments = append(slices.Clone(pign.Fragments), IgnitionFragment{Name: child.ID, Inline: cign.Inline})
+		out.Ignition.Fragments = append(out.Ignition.Fragments, cign.Fragments...)
+	default:
+		out.Ignition.Fragments = append(slices.Clone(pign.Fragments), cign.Fragments...)
+		if cign.Inline == "" {
+			out.Ignition.Inline = pign.Inline
+		} else if pign.Inline != "" {
+			merged, err := MergeIgnition(pign.Inline, cign.Inline)
+			if err != nil {
+				return Profile{}, errtrace.Errorf("profile %q: %w", child.ID, err)
+			}
+			out.Ignition.Inline = merged
+		}
+	}
+	out.Ignition.OneTime = pign.OneTime || cign.OneTime
+	return out, nil
+}
+
+// renderProfiles resolves the inheritance of every profile and validates the results.
+func renderProfiles(profiles map[string]Profile) (map[string]Profile, error) {
+	rendered := make(map[string]Profile, len(profiles))
+	var render func(id string, chain []string) (Profile, error)
+	render = func(id string, chain []string) (Profile, error) {
+		if p, ok := rendered[id]; ok {
+			return p, nil
+		}
+		if slices.Contains(chain, id) {
+			return Profile{}, errtrace.Errorf("%w: inheritance cycle %s", ErrInvalid, strings.Join(append(chain, id), " -> "))
+		}
+		p, ok := profiles[id]
+		if !ok {
+			return Profile{}, errtrace.Errorf("%w: profile %q extends %q, which does not exist", ErrInvalid, chain[len(chain)-1], id)
+		}
+		if p.Extends != "" {
+			parent, err := render(p.Extends, append(chain, id))
+			if err != nil {
+				return Profile{}, errtrace.Wrap(err)
+			}
+			if p, err = Inherit(parent, p); err != nil {
+				return Profile{}, errtrace.Wrap(err)
+			}
+			if err := p.Validate(); err != nil {
+				return Profile{}, errtrace.Errorf("profile %q: %w", id, err)
+			}
+		}
+		rendered[id] = p
+		return p, nil
+	}
+
+	for id := range profiles {
+		if _, err := render(id, nil); err != nil {
+			return nil, errtrace.Wrap(err)
+		}
+	}
+	return rendered, nil
+}
@@ -0,0 +1,220 @@
+package profile
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInherit(t *testing.T) {
+	parent := Profile{
+		ID:     "base",
+		Arch:   "amd64",
+		Labels: map[string]string{"role": "base", "site": "a"},
+		Boot: Boot{Flatcar: &Flatcar{
+			Channel: "stable",
+			Version: "current",
+			Args:    []string{"console=ttyS0"},
+		}},
+		AllowedCIDRs: []string{"10.0.0.0/8"},
+	}
+
+	tests := []struct {
+		name    string
+		parent  Profile
+		child   Profile
+		check   func(t *testing.T, got Profile)
+		wantErr error
+	}{
+		{
+			name:   "unset fields come from the parent",
+			parent: parent,
+			child:  Profile{ID: "web", Extends: "base"},
+			check: func(t *testing.T, got Profile) {
+				want := parent
+				want.ID = "web"
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("got %+v, want %+v", got, want)
+				}
+			},
+		},
+		{
+			name:   "labels are merged and args appended",
+			parent: parent,
+			child: Profile{
+				ID:     "web",
+				Labels: map[string]string{"role": "web"},
+				Boot:   Boot{Flatcar: &Flatcar{Version: "3815.2.0", Args: []string{"quiet"}}},
+			},
+			check: func(t *testing.T, got Profile) {
+				if want := map[string]string{"role": "web", "site": "a"}; !reflect.DeepEqual(got.Labels, want) {
+					t.Errorf("labels = %v, want %v", got.Labels, want)
+				}
+				want := &Flatcar{Channel: "stable", Version: "3815.2.0", Args: []string{"console=ttyS0", "quiet"}}
+				if !reflect.DeepEqual(got.Boot.Flatcar, want) {
+					t.Errorf("flatcar = %+v, want %+v", got.Boot.Flatcar, want)
+				}
+				if len(parent.Boot.Flatcar.Args) != 1 {
+					t.Errorf("parent args changed to %v", parent.Boot.Flatcar.Args)
+				}
+			},
+		},
+		{
+			name:   "inline configs are merged",
+			parent: Profile{ID: "base", Ignition: Ignition{Inline: `{"storage":{"files":[{"path":"/etc/a"}]}}`}},
+			child:  Profile{ID: "web", Ignition: Ignition{Inline: `{"storage":{"files":[{"path":"/etc/b"}]}}`}},
+			check: func(t *testing.T, got Profile) {
+				assertJSONEqual(t, got.Ignition.Inline, `{"storage":{"files":[{"path":"/etc/a"},{"path":"/etc/b"}]}}`)
+			},
+		},
+		{
+			name: "child inline goes on top of parent fragments",
+			parent: Profile{ID: "base", Ignition: Ignition{
+				Inline:    `{}`,
+				Fragments: []IgnitionFragment{{Name: "users", Inline: `{}`}},
+			}},
+			child: Profile{ID: "web", Ignition: Ignition{
+				Inline:    `{"systemd":{}}`,
+				Fragments: []IgnitionFragment{{Name: "role", Source: "https://example.com/role.ign"}},
+			}},
+			check: func(t *testing.T, got Profile) {
+				var names []string
+				for _, f := range got.Ignition.Fragments {
+					names = append(names, f.Name)
+				}
+				if want := []string{"users", "web", "role"}; !reflect.DeepEqual(names, want) {
+					t.Errorf("fragments = %v, want %v", names, want)
+				}
+				if got.Ignition.Inline != `{}` {
+					t.Errorf("inline = %s, want the parent's", got.Ignition.Inline)
+				}
+			},
+		},
+		{
+			name:   "child source replaces the parent config",
+			parent: Profile{ID: "base", Ignition: Ignition{Inline: `{}`}},
+			child:  Profile{ID: "web", Ignition: Ignition{Source: "https://example.com/web.ign"}},
+			check: func(t *testing.T, got Profile) {
+				if want := (Ignition{Source: "https://example.com/web.ign"}); !reflect.DeepEqual(got.Ignition, want) {
+					t.Errorf("ignition = %+v, want %+v", got.Ignition, want)
+				}
+			},
+		},
+		{
+			name:    "inline cannot extend a source",
+			parent:  Profile{ID: "base", Ignition: Ignition{Source: "https://example.com/base.ign"}},
+			child:   Profile{ID: "web", Ignition: Ignition{Inline: `{}`}},
+			wantErr: ErrInvalid,
+		},
+		{
+			name:   "one-time is inherited",
+			parent: Profile{ID: "base", Ignition: Ignition{Inline: `{}`, OneTime: true}},
+			child:  Profile{ID: "web", Ignition: Ignition{Inline: `{"systemd":{}}`}},
+			check: func(t *testing.T, got Profile) {
+				if !got.Ignition.OneTime {
+					t.Error("one-time was not inherited")
+				}
+			},
+		},
+		{
+			name:   "one-time cannot be turned off by a child",
+			parent: Profile{ID: "base", Ignition: Ignition{Inline: `{}`, OneTime: true}},
+			child:  Profile{ID: "web"},
+			check: func(t *testing.T, got Profile) {
+				if !got.Ignition.OneTime {
+					t.Error("one-time was dropped")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Inherit(tt.parent, tt.child)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Inherit() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Inherit() error = %v", err)
+			}
+			if got.Extends != "" {
+				t.Errorf("result still extends %q", got.Extends)
+			}
+			tt.check(t, got)
+		})
+	}
+}
+
+func TestRenderProfiles(t *testing.T) {
+	flatcar := Boot{Flatcar: &Flatcar{Channel: "stable", Version: "current"}}
+	tests := []struct {
+		name     string
+		profiles []Profile
+		wantErr  string
+	}{
+		{
+			name: "chain",
+			profiles: []Profile{
+				{ID: "a", Arch: "amd64", Boot: flatcar},
+				{ID: "b", Extends: "a"},
+				{ID: "c", Extends: "b"},
+			},
+		},
+		{
+			name: "cycle",
+			profiles: []Profile{
+				{ID: "a", Extends: "b"},
+				{ID: "b", Extends: "a"},
+			},
+			wantErr: "inheritance cycle",
+		},
+		{
+			name: "self",
+			profiles: []Profile{
+				{ID: "a", Extends: "a"},
+			},
+			wantErr: "inheritance cycle a -> a",
+		},
+		{
+			name: "missing parent",
+			profiles: []Profile{
+				{ID: "a", Extends: "nope"},
+			},
+			wantErr: `"a" extends "nope", which does not exist`,
+		},
+		{
+			name: "invalid result",
+			profiles: []Profile{
+				{ID: "a", Boot: flatcar},
+				{ID: "b", Extends: "a"},
+			},
+			wantErr: "arch is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profiles := make(map[string]Profile)
+			for _, p := range tt.profiles {
+				profiles[p.ID] = p
+			}
+			rendered, err := renderProfiles(profiles)
+			if tt.wantErr != "" {
+				if !errors.Is(err, ErrInvalid) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("renderProfiles() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("renderProfiles() error = %v", err)
+			}
+			for id, p := range rendered {
+				if p.Extends != "" || p.Arch != "amd64" {
+					t.Errorf("profile %s rendered as %+v", id, p)
+				}
+			}
+		})
+	}
+}
@@ -1,11 +1,26 @@
 package profile
 
+import (
+	"net/netip"
+	"regexp"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi"
+	"github.com/tosuke/hokuchi/flatcar"
+	"github.com/tosuke/hokuchi/secret"
+)
+
 type Profile struct {
-	ID       string            `json:"id"`
-	Arch     string            `json:"arch"`
-	Labels   map[string]string `json:"labels"`
-	Boot     Boot              `json:"boot"`
-	Ignition Ignition          `json:"ignition"`
+	ID              string            `json:"id"`
+	ResourceVersion int64             `json:"resourceVersion,omitempty"`
+	Arch            string            `json:"arch"`
+	Labels          map[string]string `json:"labels"`
+	Boot            Boot              `json:"boot"`
+	Ignition        Ignition          `json:"ignition"`
+	// AllowedCIDRs restricts which client addresses the profile is served to. Empty allows any.
+	AllowedCIDRs []string `json:"allowedCIDRs,omitempty"`
+	// Extends names a parent profile. Fields left unset are inherited from it; see Inherit.
+	Extends string `json:"extends,omitempty"`
 }
 
 type Boot struct {
@@ -13,14 +28,35 @@ type Boot struct {
 }
 
 type Flatcar struct {
-	Channel string   `json:"channel"`
-	Version string   `json:"version"`
-	Args    []string `json:"args"`
+	Channel string `json:"channel"`
+	Version string `json:"version"`
+	// Args may reference secrets as ${secret:NAME}; they are resolved when the boot script is rendered.
+	Args []string `json:"args"`
 }
 
+// Ignition is the config handed to the machine. Inline, Source and fragments may reference secrets as ${secret:NAME};
+// they are resolved when served, so stored profiles and API responses only ever carry the references.
 type Ignition struct {
 	Inline string `json:"inline,omitempty"`
 	Source string `json:"source,omitempty"`
+	// Fragments are merged in order on top of Inline when the config is served. They exclude Source.
+	Fragments []IgnitionFragment `json:"fragments,omitempty"`
+	// OneTime lets each machine retrieve the config once, until it is re-armed. It excludes Source.
+	OneTime bool `json:"oneTime,omitempty"`
+}
+
+// IgnitionFragment is a part of an Ignition config, given inline or fetched by hokuchi from Source.
+type IgnitionFragment struct {
+	Name   string `json:"name,omitempty"`
+	Inline string `json:"inline,omitempty"`
+	Source string `json:"source,omitempty"`
+	// Selector limits the fragment to the machines it matches. Empty matches every machine.
+	Selector Selector `json:"selector,omitempty"`
+}
+
+// Configured reports whether there is a config to hand to the machine.
+func (ign Ignition) Configured() bool {
+	return ign.Inline != "" || ign.Source != "" || len(ign.Fragments) > 0
 }
 
 func (p Profile) ResourceSpecs() []ResourceSpec {
@@ -35,3 +71,94 @@ func (p Profile) ResourceSpecs() []ResourceSpec {
 
 	return rs
 }
+
+var idRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9._-]{0,62})$`)
+
+func IsValidID(id string) bool {
+	return idRegex.MatchString(id)
+}
+
+// normalize puts a profile in the form it is stored in, so that validation, resource specs
+// and matching all see the same architecture name.
+func (p *Profile) normalize() {
+	p.Arch = hokuchi.NormalizeArch(p.Arch)
+}
+
+// Validate checks a profile as stored. A profile that extends another may leave out
+// what it inherits; the registry validates the result of the inheritance as well.
+func (p Profile) Validate() error {
+	if !IsValidID(p.ID) {
+		return errtrace.Errorf("%w: invalid id %q", ErrInvalid, p.ID)
+	}
+	if p.Extends != "" {
+		if !IsValidID(p.Extends) {
+			return errtrace.Errorf("%w: invalid parent id %q", ErrInvalid, p.Extends)
+		}
+	} else {
+		if p.Boot.Flatcar == nil {
+			return errtrace.Errorf("%w: boot method is required", ErrInvalid)
+		}
+		if p.Arch == "" {
+			return errtrace.Errorf("%w: arch is required", ErrInvalid)
+		}
+	}
+	if p.Arch != "" && !flatcar.IsValidArch(p.Arch) {
+		return errtrace.Errorf("%w: unsupported arch %q", ErrInvalid, p.Arch)
+	}
+	if p.Extends == "" {
+		for _, rs := range p.ResourceSpecs() {
+			if !rs.Valid() {
+				return errtrace.Errorf("%w: invalid resource", ErrInvalid)
+			}
+		}
+	}
+	if p.Ignition.Inline != "" && p.Ignition.Source != "" {
+		return errtrace.Errorf("%w: ignition inline and source are exclusive", ErrInvalid)
+	}
+	if p.Ignition.OneTime && p.Ignition.Source != "" {
+		// the machine is redirected to the source, which hokuchi cannot stop it from fetching again
+		return errtrace.Errorf("%w: one-time ignition cannot use a source", ErrInvalid)
+	}
+	if err := p.Ignition.validateFragments(); err != nil {
+		return errtrace.Wrap(err)
+	}
+	if err := validateCIDRs(p.AllowedCIDRs); err != nil {
+		return errtrace.Wrap(err)
+	}
+	refs := []string{p.Ignition.Inline, p.Ignition.Source}
+	for _, f := range p.Ignition.Fragments {
+		refs = append(refs, f.Inline, f.Source)
+	}
+	if fc := p.Boot.Flatcar; fc != nil {
+		refs = append(refs, fc.Args...)
+	}
+	for _, r := range refs {
+		if err := secret.Validate(r); err != nil {
+			return errtrace.Errorf("%w: %w", ErrInvalid, err)
+		}
+	}
+	return nil
+}
+
+func validateCIDRs(cidrs []string) error {
+	for _, c := range cidrs {
+		if _, err := netip.ParsePrefix(c); err != nil {
+			return errtrace.Errorf("%w: invalid cidr %q", ErrInvalid, c)
+		}
+	}
+	return nil
+}
+
+// AllowsAddr reports whether addr falls within one of cidrs. An empty list allows any address.
+func AllowsAddr(cidrs []string, addr netip.Addr) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, c := range cidrs {
+		if prefix, err := netip.ParsePrefix(c); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,520 @@
+package profile
+
+import (
+	"errors"
+	"maps"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi/state"
+)
+
+var (
+	ErrInvalid  = errtrace.New("profile: invalid")
+	ErrNotFound = errtrace.New("profile: not found")
+	ErrExists   = errtrace.New("profile: already exists")
+	ErrConflict = errtrace.New("profile: resource version conflict")
+	ErrInUse    = errtrace.New("profile: in use")
+	// ErrManaged is returned by writes while the profiles and groups come from sources.
+	ErrManaged = errtrace.New("profile: managed by profile sources")
+)
+
+// Registry holds the profiles and machine groups hokuchi serves.
+// Every write bumps a registry-wide resource version used for optimistic concurrency.
+type Registry struct {
+	mu       sync.RWMutex
+	version  int64
+	profiles map[string]Profile
+	groups   map[string]Group
+	// rendered holds the profiles with their inheritance resolved
+	rendered map[string]Profile
+	// managed refuses writes other than Replace, which the next load from sources would undo
+	managed bool
+
+	// db persists every write when set
+	db *state.DB
+}
+
+const registryVersionKey = "registryVersion"
+
+func NewRegistry() *Registry {
+	return &Registry{
+		profiles: make(map[string]Profile),
+		groups:   make(map[string]Group),
+		rendered: make(map[string]Profile),
+	}
+}
+
+// OpenRegistry loads a registry from db and persists subsequent writes to it.
+func OpenRegistry(db *state.DB) (*Registry, error) {
+	r := NewRegistry()
+	r.db = db
+
+	err := db.View(func(tx *state.Tx) error {
+		if err := tx.Get(state.BucketMeta, registryVersionKey, &r.version); err != nil && !errors.Is(err, state.ErrNotFound) {
+			return errtrace.Wrap(err)
+		}
+		if err := state.ForEach(tx, state.BucketProfiles, func(id string, p Profile) error {
+			// profiles stored before arch names were normalized
+			p.normalize()
+			r.profiles[id] = p
+			return nil
+		}); err != nil {
+			return errtrace.Wrap(err)
+		}
+		return state.ForEach(tx, state.BucketGroups, func(id string, g Group) error {
+			r.groups[id] = g
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	if r.rendered, err = renderProfiles(r.profiles); err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	return r, nil
+}
+
+// Empty reports whether the registry has neither profiles nor groups.
+func (r *Registry) Empty() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.profiles) == 0 && len(r.groups) == 0
+}
+
+// commit persists a write at the next resource version. It must be called with mu held,
+// before the in-memory maps are changed, so that a failed write leaves the registry untouched.
+func (r *Registry) commit(fn func(tx *state.Tx) error) error {
+	version := r.version + 1
+	if r.db != nil {
+		err := r.db.Update(func(tx *state.Tx) error {
+			if err := fn(tx); err != nil {
+				return errtrace.Wrap(err)
+			}
+			return tx.Put(state.BucketMeta, registryVersionKey, version)
+		})
+		if err != nil {
+			return errtrace.Wrap(err)
+		}
+	}
+	r.version = version
+	return nil
+}
+
+func (r *Registry) Profiles() []Profile {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ps := make([]Profile, 0, len(r.profiles))
+	for _, p := range r.profiles {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].ID < ps[j].ID })
+	return ps
+}
+
+func (r *Registry) Profile(id string) (Profile, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	p, ok := r.profiles[id]
+	return p, ok
+}
+
+// WithProfile calls fn with a profile, which cannot be deleted until fn returns.
+func (r *Registry) WithProfile(id string, fn func(Profile) error) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	p, ok := r.profiles[id]
+	if !ok {
+		return errtrace.Wrap(ErrNotFound)
+	}
+	return errtrace.Wrap(fn(p))
+}
+
+// RenderedProfiles returns every profile with its inheritance resolved.
+func (r *Registry) RenderedProfiles() []Profile {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ps := make([]Profile, 0, len(r.rendered))
+	for _, p := range r.rendered {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].ID < ps[j].ID })
+	return ps
+}
+
+// Rendered returns a profile with its inheritance resolved, as it is served to machines.
+func (r *Registry) Rendered(id string) (Profile, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	p, ok := r.rendered[id]
+	return p, ok
+}
+
+func (r *Registry) CreateProfile(p Profile) (Profile, error) {
+	p.normalize()
+	if err := p.Validate(); err != nil {
+		return Profile{}, errtrace.Wrap(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.managed {
+		return Profile{}, errtrace.Wrap(ErrManaged)
+	}
+	if _, ok := r.profiles[p.ID]; ok {
+		return Profile{}, errtrace.Wrap(ErrExists)
+	}
+	if err := r.putProfile(&p); err != nil {
+		return Profile{}, errtrace.Wrap(err)
+	}
+	return p, nil
+}
+
+// UpdateProfile replaces a profile. p.ResourceVersion must match the stored one.
+func (r *Registry) UpdateProfile(p Profile) (Profile, error) {
+	p.normalize()
+	if err := p.Validate(); err != nil {
+		return Profile{}, errtrace.Wrap(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.managed {
+		return Profile{}, errtrace.Wrap(ErrManaged)
+	}
+	cur, ok := r.profiles[p.ID]
+	if !ok {
+		return Profile{}, errtrace.Wrap(ErrNotFound)
+	}
+	if cur.ResourceVersion != p.ResourceVersion {
+		return Profile{}, errtrace.Wrap(ErrConflict)
+	}
+	if err := r.putProfile(&p); err != nil {
+		return Profile{}, errtrace.Wrap(err)
+	}
+	return p, nil
+}
+
+func (r *Registry) putProfile(p *Profile) error {
+	p.ResourceVersion = r.version + 1
+	profiles := maps.Clone(r.profiles)
+	profiles[p.ID] = *p
+	rendered, err := renderProfiles(profiles)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	err = r.commit(func(tx *state.Tx) error {
+		return tx.Put(state.BucketProfiles, p.ID, p)
+	})
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	r.profiles = profiles
+	r.rendered = rendered
+	return nil
+}
+
+// DeleteProfile removes a profile no group or profile refers to. A zero version deletes unconditionally.
+// A non-nil inUse is called before the deletion and stops it with an error; [Registry.WithProfile]
+// cannot run meanwhile.
+func (r *Registry) DeleteProfile(id string, version int64, inUse func() error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.managed {
+		return errtrace.Wrap(ErrManaged)
+	}
+	cur, ok := r.profiles[id]
+	if !ok {
+		return errtrace.Wrap(ErrNotFound)
+	}
+	if version != 0 && cur.ResourceVersion != version {
+		return errtrace.Wrap(ErrConflict)
+	}
+	for _, g := range r.groups {
+		if slices.Contains(g.ProfileIDs(), id) {
+			return errtrace.Errorf("%w: referenced by group %q", ErrInUse, g.ID)
+		}
+	}
+	for _, p := range r.profiles {
+		if p.Extends == id {
+			return errtrace.Errorf("%w: extended by profile %q", ErrInUse, p.ID)
+		}
+	}
+	if inUse != nil {
+		if err := inUse(); err != nil {
+			return errtrace.Wrap(err)
+		}
+	}
+	if err := r.commit(func(tx *state.Tx) error {
+		return tx.Delete(state.BucketProfiles, id)
+	}); err != nil {
+		return errtrace.Wrap(err)
+	}
+	delete(r.profiles, id)
+	delete(r.rendered, id)
+	return nil
+}
+
+func (r *Registry) Groups() []Group {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	gs := make([]Group, 0, len(r.groups))
+	for _, g := range r.groups {
+		gs = append(gs, g)
+	}
+	sort.Slice(gs, func(i, j int) bool { return gs[i].ID < gs[j].ID })
+	return gs
+}
+
+func (r *Registry) Group(id string) (Group, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	g, ok := r.groups[id]
+	return g, ok
+}
+
+func (r *Registry) CreateGroup(g Group) (Group, error) {
+	if err := g.Validate(); err != nil {
+		return Group{}, errtrace.Wrap(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.managed {
+		return Group{}, errtrace.Wrap(ErrManaged)
+	}
+	if _, ok := r.groups[g.ID]; ok {
+		return Group{}, errtrace.Wrap(ErrExists)
+	}
+	for _, id := range g.ProfileIDs() {
+		if _, ok := r.profiles[id]; !ok {
+			return Group{}, errtrace.Errorf("%w: profile %q does not exist", ErrInvalid, id)
+		}
+	}
+	if err := r.putGroup(&g); err != nil {
+		return Group{}, errtrace.Wrap(err)
+	}
+	return g, nil
+}
+
+// UpdateGroup replaces a group. g.ResourceVersion must match the stored one.
+func (r *Registry) UpdateGroup(g Group) (Group, error) {
+	if err := g.Validate(); err != nil {
+		return Group{}, errtrace.Wrap(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.managed {
+		return Group{}, errtrace.Wrap(ErrManaged)
+	}
+	cur, ok := r.groups[g.ID]
+	if !ok {
+		return Group{}, errtrace.Wrap(ErrNotFound)
+	}
+	if cur.ResourceVersion != g.ResourceVersion {
+		return Group{}, errtrace.Wrap(ErrConflict)
+	}
+	for _, id := range g.ProfileIDs() {
+		if _, ok := r.profiles[id]; !ok {
+			return Group{}, errtrace.Errorf("%w: profile %q does not exist", ErrInvalid, id)
+		}
+	}
+	if err := r.putGroup(&g); err != nil {
+		return Group{}, errtrace.Wrap(err)
+	}
+	return g, nil
+}
+
+// DeleteGroup removes a group. A zero version deletes unconditionally.
+func (r *Registry) DeleteGroup(id string, version int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.managed {
+		return errtrace.Wrap(ErrManaged)
+	}
+	cur, ok := r.groups[id]
+	if !ok {
+		return errtrace.Wrap(ErrNotFound)
+	}
+	if version != 0 && cur.ResourceVersion != version {
+		return errtrace.Wrap(ErrConflict)
+	}
+	if err := r.commit(func(tx *state.Tx) error {
+		return tx.Delete(state.BucketGroups, id)
+	}); err != nil {
+		return errtrace.Wrap(err)
+	}
+	delete(r.groups, id)
+	return nil
+}
+
+func (r *Registry) putGroup(g *Group) error {
+	g.ResourceVersion = r.version + 1
+	err := r.commit(func(tx *state.Tx) error {
+		return tx.Put(state.BucketGroups, g.ID, g)
+	})
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	r.groups[g.ID] = *g
+	return nil
+}
+
+// SetManaged tells whether the profiles and groups come from sources. While they do,
+// only Replace changes them and every other write fails with ErrManaged.
+func (r *Registry) SetManaged(managed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.managed = managed
+}
+
+// Replace swaps the whole set of profiles and groups in a single write.
+// Items equal to the stored ones keep their resource version; everything else is
+// validated up front so that an invalid set leaves the registry untouched.
+func (r *Registry) Replace(profiles []Profile, groups []Group) error {
+	newProfiles := make(map[string]Profile, len(profiles))
+	for _, p := range profiles {
+		p.normalize()
+		if err := p.Validate(); err != nil {
+			return errtrace.Wrap(err)
+		}
+		if _, ok := newProfiles[p.ID]; ok {
+			return errtrace.Errorf("%w: duplicate profile %q", ErrInvalid, p.ID)
+		}
+		newProfiles[p.ID] = p
+	}
+	newGroups := make(map[string]Group, len(groups))
+	for _, g := range groups {
+		if err := g.Validate(); err != nil {
+			return errtrace.Wrap(err)
+		}
+		if _, ok := newGroups[g.ID]; ok {
+			return errtrace.Errorf("%w: duplicate group %q", ErrInvalid, g.ID)
+		}
+		for _, id := range g.ProfileIDs() {
+			if _, ok := newProfiles[id]; !ok {
+				return errtrace.Errorf("%w: group %q: profile %q does not exist", ErrInvalid, g.ID, id)
+			}
+		}
+		newGroups[g.ID] = g
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	version := r.version + 1
+	// an unchanged set is not written, so that reloading it does not bump the version
+	changed := len(newProfiles) != len(r.profiles) || len(newGroups) != len(r.groups)
+	for id, p := range newProfiles {
+		if cur, ok := r.profiles[id]; ok {
+			p.ResourceVersion = cur.ResourceVersion
+			if reflect.DeepEqual(cur, p) {
+				continue
+			}
+		}
+		changed = true
+		p.ResourceVersion = version
+		newProfiles[id] = p
+	}
+	for id, g := range newGroups {
+		if cur, ok := r.groups[id]; ok {
+			g.ResourceVersion = cur.ResourceVersion
+			if reflect.DeepEqual(cur, g) {
+				continue
+			}
+		}
+		changed = true
+		g.ResourceVersion = version
+		newGroups[id] = g
+	}
+	if !changed {
+		return nil
+	}
+	rendered, err := renderProfiles(newProfiles)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+
+	err = r.commit(func(tx *state.Tx) error {
+		for id := range r.profiles {
+			if _, ok := newProfiles[id]; !ok {
+				if err := tx.Delete(state.BucketProfiles, id); err != nil {
+					return errtrace.Wrap(err)
+				}
+			}
+		}
+		for id := range r.groups {
+			if _, ok := newGroups[id]; !ok {
+				if err := tx.Delete(state.BucketGroups, id); err != nil {
+					return errtrace.Wrap(err)
+				}
+			}
+		}
+		for id, p := range newProfiles {
+			if err := tx.Put(state.BucketProfiles, id, p); err != nil {
+				return errtrace.Wrap(err)
+			}
+		}
+		for id, g := range newGroups {
+			if err := tx.Put(state.BucketGroups, id, g); err != nil {
+				return errtrace.Wrap(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	r.profiles = newProfiles
+	r.groups = newGroups
+	r.rendered = rendered
+	return nil
+}
+
+// Match returns the rendered profile of the most specific group whose selector matches m.
+// Ties are broken by group ID.
+func (r *Registry) Match(m Machine) (Profile, Group, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var (
+		best  Group
+		found bool
+	)
+	for _, g := range r.groups {
+		if !g.Selector.Matches(m) {
+			continue
+		}
+		if !found || g.Selector.specificity() > best.Selector.specificity() ||
+			(g.Selector.specificity() == best.Selector.specificity() && g.ID < best.ID) {
+			best, found = g, true
+		}
+	}
+	if !found {
+		return Profile{}, Group{}, false
+	}
+	p, ok := r.rendered[best.ProfileID]
+	if !ok {
+		return Profile{}, Group{}, false
+	}
+	return p, best, true
+}
@@ -0,0 +1,45 @@
+package profile
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestManagedRegistry(t *testing.T) {
+	flatcar := Boot{Flatcar: &Flatcar{Channel: "stable", Version: "current"}}
+	r := NewRegistry()
+	if err := r.Replace([]Profile{{ID: "web", Arch: "amd64", Boot: flatcar}}, []Group{{ID: "all", ProfileID: "web"}}); err != nil {
+		t.Fatal(err)
+	}
+	r.SetManaged(true)
+
+	web, _ := r.Profile("web")
+	all, _ := r.Group("all")
+	writes := map[string]func() error{
+		"CreateProfile": func() error {
+			_, err := r.CreateProfile(Profile{ID: "db", Arch: "amd64", Boot: flatcar})
+			return err
+		},
+		"UpdateProfile": func() error { _, err := r.UpdateProfile(web); return err },
+		"DeleteProfile": func() error { return r.DeleteProfile("web", 0, nil) },
+		"CreateGroup": func() error {
+			_, err := r.CreateGroup(Group{ID: "other", ProfileID: "web"})
+			return err
+		},
+		"UpdateGroup": func() error { _, err := r.UpdateGroup(all); return err },
+		"DeleteGroup": func() error { return r.DeleteGroup("all", 0) },
+	}
+	for name, write := range writes {
+		if err := write(); !errors.Is(err, ErrManaged) {
+			t.Errorf("%s() error = %v, want %v", name, err, ErrManaged)
+		}
+	}
+	if err := r.Replace([]Profile{{ID: "db", Arch: "amd64", Boot: flatcar}}, nil); err != nil {
+		t.Fatalf("Replace() error = %v", err)
+	}
+
+	r.SetManaged(false)
+	if err := r.DeleteProfile("db", 0, nil); err != nil {
+		t.Fatalf("DeleteProfile() once unmanaged: error = %v", err)
+	}
+}
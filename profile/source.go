@@ -0,0 +1,96 @@
+package profile
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"braces.dev/errtrace"
+	"gopkg.in/yaml.v3"
+)
+
+// sourceFile is the layout of a profile source. Fields use the same names as the admin API.
+type sourceFile struct {
+	Profiles []Profile `json:"profiles"`
+	Groups   []Group   `json:"groups"`
+}
+
+var sourceExts = map[string]bool{".yaml": true, ".yml": true, ".json": true}
+
+// LoadSources reads profiles and groups from YAML or JSON files.
+// A directory contributes every such file directly inside it, in lexical order.
+func LoadSources(paths []string) ([]Profile, []Group, error) {
+	var (
+		profiles []Profile
+		groups   []Group
+	)
+	for _, path := range paths {
+		files, err := sourceFiles(path)
+		if err != nil {
+			return nil, nil, errtrace.Wrap(err)
+		}
+		for _, file := range files {
+			sf, err := loadSourceFile(file)
+			if err != nil {
+				return nil, nil, errtrace.Errorf("%s: %w", file, err)
+			}
+			profiles = append(profiles, sf.Profiles...)
+			groups = append(groups, sf.Groups...)
+		}
+	}
+	return profiles, groups, nil
+}
+
+func sourceFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && sourceExts[filepath.Ext(e.Name())] {
+			files = append(files, filepath.Join(path, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func loadSourceFile(path string) (sourceFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return sourceFile{}, errtrace.Wrap(err)
+	}
+
+	// YAML is converted to JSON so that both formats share the API field names and strictness
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return sourceFile{}, errtrace.Errorf("%w: %w", ErrInvalid, err)
+	}
+	if doc == nil {
+		return sourceFile{}, nil
+	}
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return sourceFile{}, errtrace.Errorf("%w: %w", ErrInvalid, err)
+	}
+
+	var sf sourceFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sf); err != nil && err != io.EOF {
+		return sourceFile{}, errtrace.Errorf("%w: %w", ErrInvalid, err)
+	}
+	return sf, nil
+}
@@ -0,0 +1,145 @@
+package secret
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"braces.dev/errtrace"
+)
+
+var (
+	ErrNotFound    = errtrace.New("secret: not found")
+	ErrInvalidName = errtrace.New("secret: invalid name")
+	// ErrInvalidValue is returned when a secret cannot be placed where it is referenced.
+	ErrInvalidValue = errtrace.New("secret: invalid value")
+)
+
+// EnvPrefix is prepended to a secret name, upper-cased with '-' and '.' turned into '_', to find it in the environment.
+const EnvPrefix = "HOKUCHI_SECRET_"
+
+// refRegex matches references of the form ${secret:NAME}.
+var refRegex = regexp.MustCompile(`\$\{secret:([^}]*)\}`)
+
+var nameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// Store resolves secrets by name from files in a directory and from the environment.
+// Files take precedence, and trailing newlines are removed from either. A nil Store resolves nothing.
+type Store struct {
+	// Dir holds one file per secret, named after it.
+	Dir string
+}
+
+func (s *Store) Lookup(name string) (string, error) {
+	if !nameRegex.MatchString(name) {
+		return "", errtrace.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	if s == nil {
+		return "", errtrace.Errorf("%w: %q", ErrNotFound, name)
+	}
+	if s.Dir != "" {
+		data, err := os.ReadFile(filepath.Join(s.Dir, name))
+		if err == nil {
+			return strings.TrimRight(string(data), "\r\n"), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", errtrace.Wrap(err)
+		}
+	}
+	if v, ok := os.LookupEnv(envName(name)); ok {
+		return strings.TrimRight(v, "\r\n"), nil
+	}
+	return "", errtrace.Errorf("%w: %q", ErrNotFound, name)
+}
+
+func envName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+// Expand replaces every reference in str with the secret it names.
+// Errors name the missing secret but never include secret values.
+func (s *Store) Expand(str string) (string, error) {
+	return errtrace.Wrap2(s.expand(str, func(_, v string, _ bool) (string, error) { return v, nil }))
+}
+
+// ExpandJSON is Expand for a JSON document whose references sit within string values:
+// each secret is escaped, so that quotes and newlines in it cannot change the document.
+func (s *Store) ExpandJSON(str string) (string, error) {
+	return errtrace.Wrap2(s.expand(str, func(_, v string, _ bool) (string, error) {
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return "", errtrace.Wrap(err)
+		}
+		// drop the quotes and the newline added by Encode
+		quoted := bytes.TrimSuffix(b.Bytes(), []byte("\n"))
+		return string(quoted[1 : len(quoted)-1]), nil
+	}))
+}
+
+// ExpandArgs expands each of args, which are separated by whitespace where they are used,
+// such as kernel arguments in a boot script. Secrets with control characters are refused, as they
+// would add commands of their own, and so are secrets with whitespace unless the reference is
+// enclosed in double quotes, like sshkey="${secret:sshkey}", and the secret has none.
+func (s *Store) ExpandArgs(args []string) ([]string, error) {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		v, err := s.expand(arg, func(name, v string, quoted bool) (string, error) {
+			if strings.ContainsFunc(v, unicode.IsControl) {
+				return "", errtrace.Errorf("%w: %q contains control characters", ErrInvalidValue, name)
+			}
+			if quoted {
+				if strings.ContainsFunc(v, func(r rune) bool { return r == '"' || (r != ' ' && unicode.IsSpace(r)) }) {
+					return "", errtrace.Errorf("%w: quoted %q contains quotes or whitespace other than spaces", ErrInvalidValue, name)
+				}
+			} else if strings.ContainsFunc(v, unicode.IsSpace) {
+				return "", errtrace.Errorf("%w: %q contains whitespace but is not quoted", ErrInvalidValue, name)
+			}
+			return v, nil
+		})
+		if err != nil {
+			return nil, errtrace.Wrap(err)
+		}
+		out[i] = v
+	}
+	return out, nil
+}
+
+// expand replaces the references in str with the secrets they name, passed through quote.
+// quoted tells quote whether the reference is enclosed in double quotes.
+func (s *Store) expand(str string, quote func(name, v string, quoted bool) (string, error)) (string, error) {
+	var b strings.Builder
+	last := 0
+	for _, m := range refRegex.FindAllStringSubmatchIndex(str, -1) {
+		start, end := m[0], m[1]
+		name := str[m[2]:m[3]]
+		v, err := s.Lookup(name)
+		if err != nil {
+			return "", errtrace.Wrap(err)
+		}
+		quoted := start > 0 && str[start-1] == '"' && end < len(str) && str[end] == '"'
+		if v, err = quote(name, v, quoted); err != nil {
+			return "", errtrace.Wrap(err)
+		}
+		b.WriteString(str[last:start])
+		b.WriteString(v)
+		last = end
+	}
+	b.WriteString(str[last:])
+	return b.String(), nil
+}
+
+// Validate checks that every reference in str names a well-formed secret.
+func Validate(str string) error {
+	for _, m := range refRegex.FindAllStringSubmatch(str, -1) {
+		if !nameRegex.MatchString(m[1]) {
+			return errtrace.Errorf("%w: %q", ErrInvalidName, m[1])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package secret
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestStore(t *testing.T, secrets map[string]string) *Store {
+	t.Helper()
+	dir := t.TempDir()
+	for name, v := range secrets {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(v), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Store{Dir: dir}
+}
+
+func TestLookup(t *testing.T) {
+	s := newTestStore(t, map[string]string{"token": "from-file\n", "both": "file"})
+	t.Setenv(EnvPrefix+"BOTH", "env")
+	t.Setenv(EnvPrefix+"SSH_KEY_V2", "from-env\r\n")
+
+	tests := []struct {
+		name    string
+		store   *Store
+		want    string
+		wantErr error
+	}{
+		{name: "token", store: s, want: "from-file"},
+		{name: "both", store: s, want: "file"},
+		{name: "ssh-key.v2", store: s, want: "from-env"},
+		{name: "missing", store: s, wantErr: ErrNotFound},
+		{name: "../token", store: s, wantErr: ErrInvalidName},
+		{name: "", store: s, wantErr: ErrInvalidName},
+		{name: "token", store: nil, wantErr: ErrNotFound},
+		{name: "ssh-key.v2", store: &Store{}, want: "from-env"},
+	}
+	for _, tt := range tests {
+		got, err := tt.store.Lookup(tt.name)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Lookup(%q) error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("Lookup(%q) = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	s := newTestStore(t, map[string]string{
+		"password": `p"a\ss` + "\nword",
+		"user":     "core",
+	})
+
+	tests := []struct {
+		name     string
+		in       string
+		want     string
+		wantJSON string
+		wantErr  error
+	}{
+		{name: "no reference", in: "plain", want: "plain", wantJSON: "plain"},
+		{name: "several", in: "${secret:user}:${secret:user}", want: "core:core", wantJSON: "core:core"},
+		{
+			name:     "escaped in json",
+			in:       `{"password":"${secret:password}"}`,
+			want:     `{"password":"p"a\ss` + "\nword" + `"}`,
+			wantJSON: `{"password":"p\"a\\ss\nword"}`,
+		},
+		{name: "missing", in: "${secret:nope}", wantErr: ErrNotFound},
+		{name: "invalid name", in: "${secret:a/b}", wantErr: ErrInvalidName},
+		{name: "unterminated", in: "${secret:user", want: "${secret:user", wantJSON: "${secret:user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Expand(tt.in)
+			gotJSON, errJSON := s.ExpandJSON(tt.in)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) || !errors.Is(errJSON, tt.wantErr) {
+					t.Fatalf("errors = %v, %v; want %v", err, errJSON, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Expand() = %q, %v; want %q", got, err, tt.want)
+			}
+			if errJSON != nil || gotJSON != tt.wantJSON {
+				t.Errorf("ExpandJSON() = %q, %v; want %q", gotJSON, errJSON, tt.wantJSON)
+			}
+		})
+	}
+}
+
+func TestExpandArgs(t *testing.T) {
+	s := newTestStore(t, map[string]string{
+		"sshkey":  "ssh-ed25519 AAAA core@host",
+		"token":   "abc123",
+		"newline": "abc\ndef",
+		"control": "abc\x1bdef",
+		"tab":     "abc\tdef",
+		"quote":   `abc" def`,
+	})
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    []string
+		wantErr error
+	}{
+		{name: "unquoted", args: []string{"console=ttyS0", "token=${secret:token}"}, want: []string{"console=ttyS0", "token=abc123"}},
+		{name: "quoted with spaces", args: []string{`sshkey="${secret:sshkey}"`}, want: []string{`sshkey="ssh-ed25519 AAAA core@host"`}},
+		{name: "unquoted with spaces", args: []string{"sshkey=${secret:sshkey}"}, wantErr: ErrInvalidValue},
+		{name: "quoted on one side only", args: []string{`sshkey="${secret:sshkey}`}, wantErr: ErrInvalidValue},
+		{name: "quoted newline", args: []string{`x="${secret:newline}"`}, wantErr: ErrInvalidValue},
+		{name: "unquoted newline", args: []string{"x=${secret:newline}"}, wantErr: ErrInvalidValue},
+		{name: "control character", args: []string{`x="${secret:control}"`}, wantErr: ErrInvalidValue},
+		{name: "quoted tab", args: []string{`x="${secret:tab}"`}, wantErr: ErrInvalidValue},
+		{name: "quote in quoted", args: []string{`x="${secret:quote}"`}, wantErr: ErrInvalidValue},
+		{name: "missing", args: []string{"x=${secret:nope}"}, wantErr: ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.ExpandArgs(tt.args)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ExpandArgs() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ExpandArgs() = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// TestErrorsRedactValues makes sure that errors name a secret without revealing it.
+func TestErrorsRedactValues(t *testing.T) {
+	const value = "hunter2 hunter2"
+	s := newTestStore(t, map[string]string{"password": value})
+
+	var errs []error
+	for _, args := range [][]string{
+		{"password=${secret:password}"},
+		{`password="${secret:password}"`, "${secret:missing}"},
+	} {
+		if _, err := s.ExpandArgs(args); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 2 {
+		t.Fatalf("got %d errors, want 2", len(errs))
+	}
+	for _, err := range errs {
+		if strings.Contains(err.Error(), "hunter2") {
+			t.Errorf("error reveals the secret: %v", err)
+		}
+		if !strings.Contains(err.Error(), "password") && !strings.Contains(err.Error(), "missing") {
+			t.Errorf("error does not name the secret: %v", err)
+		}
+	}
+}
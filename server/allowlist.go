@@ -0,0 +1,71 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tosuke/hokuchi/profile"
+	"github.com/tosuke/hokuchi/slogerr"
+)
+
+// clientAddr parses the address of the client that sent r.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(sourceIP(r))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
+
+// allowed reports whether r comes from an address within cidrs. An empty list allows any client.
+func allowed(r *http.Request, cidrs []string) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+	addr, ok := clientAddr(r)
+	return ok && profile.AllowsAddr(cidrs, addr)
+}
+
+// allowlist rejects clients outside cidrs with deny.
+func allowlist(cidrs []string, deny http.HandlerFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !allowed(r, cidrs) {
+				slog.WarnContext(r.Context(), "rejected client outside allowlist", slog.String("source_ip", sourceIP(r)), slog.String("path", r.URL.Path))
+				deny(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func denyIPXE(w http.ResponseWriter, r *http.Request) {
+	if err := renderIPXEError(w, http.StatusForbidden, "this client may not boot from here"); err != nil {
+		slog.ErrorContext(r.Context(), "Error writing ipxe response", slogerr.Err(err))
+	}
+}
+
+func denyForbidden(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+func denyAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusForbidden, apiError{Error: http.StatusText(http.StatusForbidden)})
+}
+
+// profileAllowlist enforces the allowlist of the profile named by the {pid} URL parameter.
+func (s *Server) profileAllowlist(deny http.HandlerFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if p, ok := s.Profiles.Rendered(chi.URLParam(r, "pid")); ok && !allowed(r, p.AllowedCIDRs) {
+				slog.WarnContext(r.Context(), "rejected client outside profile allowlist", slog.String("profile", p.ID), slog.String("source_ip", sourceIP(r)))
+				deny(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tosuke/hokuchi/profile"
+)
+
+func TestAllowlist(t *testing.T) {
+	tests := []struct {
+		name   string
+		cidrs  []string
+		remote string
+		want   bool
+	}{
+		{name: "empty list", remote: "198.51.100.1:1234", want: true},
+		{name: "inside", cidrs: []string{"10.0.0.0/8"}, remote: "10.1.2.3:1234", want: true},
+		{name: "outside", cidrs: []string{"10.0.0.0/8"}, remote: "198.51.100.1:1234"},
+		{name: "second network", cidrs: []string{"10.0.0.0/8", "192.168.0.0/16"}, remote: "192.168.1.1:1234", want: true},
+		{name: "single address", cidrs: []string{"192.0.2.7/32"}, remote: "192.0.2.7:1234", want: true},
+		{name: "ipv6", cidrs: []string{"2001:db8::/32"}, remote: "[2001:db8::1]:1234", want: true},
+		{name: "ipv6 outside", cidrs: []string{"2001:db8::/32"}, remote: "[2001:db9::1]:1234"},
+		{name: "ipv4-mapped ipv6", cidrs: []string{"10.0.0.0/8"}, remote: "[::ffff:10.0.0.1]:1234", want: true},
+		{name: "ipv4 network does not match ipv6", cidrs: []string{"0.0.0.0/0"}, remote: "[2001:db8::1]:1234"},
+		{name: "unparsable address", cidrs: []string{"0.0.0.0/0"}, remote: "pipe"},
+		{name: "malformed entry skipped", cidrs: []string{"10.0.0.0/33", "10.0.0.0/8"}, remote: "10.0.0.1:1234", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := allowlist(tt.cidrs, denyForbidden)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			r := httptest.NewRequest("GET", "/boot.ipxe", nil)
+			r.RemoteAddr = tt.remote
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			want := http.StatusForbidden
+			if tt.want {
+				want = http.StatusNoContent
+			}
+			if w.Code != want {
+				t.Errorf("status = %d, want %d", w.Code, want)
+			}
+		})
+	}
+}
+
+func TestProfileAllowlist(t *testing.T) {
+	profiles := profile.NewRegistry()
+	for _, p := range []profile.Profile{
+		{ID: "base", Arch: "amd64", Boot: profile.Boot{Flatcar: &profile.Flatcar{Channel: "stable", Version: "current"}}, AllowedCIDRs: []string{"10.0.0.0/8"}},
+		{ID: "web", Extends: "base"},
+		{ID: "open", Arch: "amd64", Boot: profile.Boot{Flatcar: &profile.Flatcar{Channel: "stable", Version: "current"}}},
+	} {
+		if _, err := profiles.CreateProfile(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{Profiles: profiles}
+	router := chi.NewRouter()
+	router.With(s.profileAllowlist(denyForbidden)).Get("/profile/{pid}/ignition", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name   string
+		pid    string
+		remote string
+		want   int
+	}{
+		{name: "inside", pid: "base", remote: "10.0.0.1:1234", want: http.StatusNoContent},
+		{name: "outside", pid: "base", remote: "192.0.2.1:1234", want: http.StatusForbidden},
+		{name: "inherited", pid: "web", remote: "192.0.2.1:1234", want: http.StatusForbidden},
+		{name: "no allowlist", pid: "open", remote: "192.0.2.1:1234", want: http.StatusNoContent},
+		// the handler reports the missing profile itself
+		{name: "unknown profile", pid: "nope", remote: "192.0.2.1:1234", want: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/profile/"+tt.pid+"/ignition", nil)
+			r.RemoteAddr = tt.remote
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"braces.dev/errtrace"
+	"github.com/go-chi/chi/v5"
+	"github.com/tosuke/hokuchi/inventory"
+	"github.com/tosuke/hokuchi/profile"
+	"github.com/tosuke/hokuchi/slogerr"
+)
+
+const maxAPIBodySize = 1 << 20
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func (s *Server) apiRoutes(r chi.Router) {
+	r.Use(s.requireRole)
+	r.Route("/profiles", func(r chi.Router) {
+		r.Get("/", s.HandleListProfiles)
+		r.Post("/", s.HandleCreateProfile)
+		r.Get("/{id}", s.HandleGetProfile)
+		r.Get("/{id}/rendered", s.HandleGetRenderedProfile)
+		r.Put("/{id}", s.HandleUpdateProfile)
+		r.Delete("/{id}", s.HandleDeleteProfile)
+	})
+	r.Route("/groups", func(r chi.Router) {
+		r.Get("/", s.HandleListGroups)
+		r.Post("/", s.HandleCreateGroup)
+		r.Get("/{id}", s.HandleGetGroup)
+		r.Put("/{id}", s.HandleUpdateGroup)
+		r.Delete("/{id}", s.HandleDeleteGroup)
+	})
+	r.Route("/machines", func(r chi.Router) {
+		r.Get("/", s.HandleListMachines)
+		r.Get("/{id}", s.HandleGetMachine)
+		r.Get("/{id}/events", s.HandleMachineEvents)
+		r.Get("/{id}/provisioning", s.HandleMachineProvisioning)
+		r.Post("/{id}/rearm", s.HandleRearmMachine)
+		r.Post("/{id}/approve", s.HandleApproveMachine)
+	})
+}
+
+func (s *Server) HandleListProfiles(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.Profiles.Profiles())
+}
+
+func (s *Server) HandleGetProfile(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.Profiles.Profile(chi.URLParam(r, "id"))
+	if !ok {
+		writeAPIError(w, r, errtrace.Wrap(profile.ErrNotFound))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, p)
+}
+
+// HandleGetRenderedProfile shows a profile with its inheritance resolved, as machines get it.
+// Secret references are left unresolved.
+func (s *Server) HandleGetRenderedProfile(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.Profiles.Rendered(chi.URLParam(r, "id"))
+	if !ok {
+		writeAPIError(w, r, errtrace.Wrap(profile.ErrNotFound))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, p)
+}
+
+func (s *Server) HandleCreateProfile(w http.ResponseWriter, r *http.Request) {
+	var p profile.Profile
+	if err := readJSON(r, &p); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	created, err := s.Profiles.CreateProfile(p)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusCreated, created)
+}
+
+func (s *Server) HandleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	var p profile.Profile
+	if err := readJSON(r, &p); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if id := chi.URLParam(r, "id"); p.ID != id {
+		writeAPIError(w, r, errtrace.Errorf("%w: id %q does not match path", profile.ErrInvalid, p.ID))
+		return
+	}
+	updated, err := s.Profiles.UpdateProfile(p)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, updated)
+}
+
+func (s *Server) HandleDeleteProfile(w http.ResponseWriter, r *http.Request) {
+	version, err := resourceVersionFromQuery(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	id := chi.URLParam(r, "id")
+	var inUse func() error
+	if s.Inventory != nil {
+		// checked under the registry lock, so that an approval cannot assign the profile meanwhile
+		inUse = func() error {
+			machines, err := s.Inventory.List(r.Context())
+			if err != nil {
+				return errtrace.Wrap(err)
+			}
+			for _, m := range machines {
+				if m.AssignedProfileID == id {
+					return errtrace.Errorf("%w: assigned to machine %q", profile.ErrInUse, m.ID)
+				}
+			}
+			return nil
+		}
+	}
+	if err := s.Profiles.DeleteProfile(id, version, inUse); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) HandleListGroups(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, s.Profiles.Groups())
+}
+
+func (s *Server) HandleGetGroup(w http.ResponseWriter, r *http.Request) {
+	g, ok := s.Profiles.Group(chi.URLParam(r, "id"))
+	if !ok {
+		writeAPIError(w, r, errtrace.Wrap(profile.ErrNotFound))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, g)
+}
+
+func (s *Server) HandleCreateGroup(w http.ResponseWriter, r *http.Request) {
+	var g profile.Group
+	if err := readJSON(r, &g); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	created, err := s.Profiles.CreateGroup(g)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusCreated, created)
+}
+
+func (s *Server) HandleUpdateGroup(w http.ResponseWriter, r *http.Request) {
+	var g profile.Group
+	if err := readJSON(r, &g); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if id := chi.URLParam(r, "id"); g.ID != id {
+		writeAPIError(w, r, errtrace.Errorf("%w: id %q does not match path", profile.ErrInvalid, g.ID))
+		return
+	}
+	updated, err := s.Profiles.UpdateGroup(g)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, updated)
+}
+
+func (s *Server) HandleDeleteGroup(w http.ResponseWriter, r *http.Request) {
+	version, err := resourceVersionFromQuery(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if err := s.Profiles.DeleteGroup(chi.URLParam(r, "id"), version); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var errBadRequest = errtrace.New("bad request")
+
+func resourceVersionFromQuery(r *http.Request) (int64, error) {
+	q := r.URL.Query().Get("resourceVersion")
+	if q == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(q, 10, 64)
+	if err != nil {
+		return 0, errtrace.Errorf("%w: invalid resourceVersion", errBadRequest)
+	}
+	return v, nil
+}
+
+func readJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxAPIBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errtrace.Errorf("%w: %w", errBadRequest, err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.ErrorContext(r.Context(), "Error writing api response", slogerr.Err(err))
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, r *http.Request, err error) {
+	var status int
+	switch {
+	case errors.Is(err, errBadRequest), errors.Is(err, profile.ErrInvalid):
+		status = http.StatusBadRequest
+	case errors.Is(err, profile.ErrNotFound), errors.Is(err, inventory.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, profile.ErrExists), errors.Is(err, profile.ErrConflict), errors.Is(err, profile.ErrInUse),
+		errors.Is(err, profile.ErrManaged):
+		status = http.StatusConflict
+	default:
+		status = http.StatusInternalServerError
+		slog.ErrorContext(r.Context(), "Error handling api request", slogerr.Err(err))
+		writeJSON(w, r, status, apiError{Error: http.StatusText(status)})
+		return
+	}
+	writeJSON(w, r, status, apiError{Error: err.Error()})
+}
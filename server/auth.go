@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"braces.dev/errtrace"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Role is what an authenticated caller may do with the admin API.
+type Role int
+
+const (
+	RoleNone Role = iota
+	// RoleRead allows reading resources
+	RoleRead
+	// RoleWrite allows reading and changing resources
+	RoleWrite
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleRead:
+		return "read"
+	case RoleWrite:
+		return "write"
+	}
+	return "none"
+}
+
+func (r *Role) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "read":
+		*r = RoleRead
+	case "write":
+		*r = RoleWrite
+	default:
+		return errtrace.Errorf("unknown role %q", text)
+	}
+	return nil
+}
+
+// Identity is an authenticated caller of the admin API.
+type Identity struct {
+	Name string
+	Role Role
+	// Method is how the caller authenticated, "token" or "cert"
+	Method string
+}
+
+// Token is a bearer token accepted by the admin API.
+type Token struct {
+	Name  string `yaml:"name"`
+	Role  Role   `yaml:"role"`
+	Token string `yaml:"token"`
+}
+
+// Authenticator identifies admin API callers by bearer token or verified client certificate.
+// Its credentials can be replaced while serving.
+type Authenticator struct {
+	tokens      atomic.Pointer[[]hashedToken]
+	clientRoles atomic.Pointer[map[string]Role]
+}
+
+type hashedToken struct {
+	name string
+	role Role
+	hash [sha256.Size]byte
+}
+
+func NewAuthenticator(tokens []Token, clientRoles map[string]Role) *Authenticator {
+	a := &Authenticator{}
+	a.SetTokens(tokens)
+	a.SetClientRoles(clientRoles)
+	return a
+}
+
+func (a *Authenticator) SetTokens(tokens []Token) {
+	hashed := make([]hashedToken, 0, len(tokens))
+	for _, t := range tokens {
+		hashed = append(hashed, hashedToken{name: t.Name, role: t.Role, hash: sha256.Sum256([]byte(t.Token))})
+	}
+	a.tokens.Store(&hashed)
+}
+
+// SetClientRoles maps the common names of verified client certificates to roles.
+func (a *Authenticator) SetClientRoles(roles map[string]Role) {
+	a.clientRoles.Store(&roles)
+}
+
+// Authenticate returns the identity of the caller of r, if any.
+func (a *Authenticator) Authenticate(r *http.Request) (Identity, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		// compare digests so that the time taken does not depend on the token
+		hash := sha256.Sum256([]byte(token))
+		var (
+			found Identity
+			ok    bool
+		)
+		for _, t := range *a.tokens.Load() {
+			if subtle.ConstantTimeCompare(hash[:], t.hash[:]) == 1 {
+				found, ok = Identity{Name: t.name, Role: t.role, Method: "token"}, true
+			}
+		}
+		return found, ok
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if role, ok := (*a.clientRoles.Load())[cn]; ok {
+			return Identity{Name: cn, Role: role, Method: "cert"}, true
+		}
+	}
+	return Identity{}, false
+}
+
+type identityKey struct{}
+
+// IdentityFromContext returns the caller authenticated for the request, if any.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// requireRole rejects callers that are not authenticated or lack the role the method needs:
+// RoleRead for safe methods and RoleWrite for everything else. Every mutation is audited.
+func (s *Server) requireRole(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		need := RoleWrite
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			need = RoleRead
+		}
+
+		var id Identity
+		if s.Auth != nil {
+			var ok bool
+			id, ok = s.Auth.Authenticate(r)
+			if !ok {
+				s.audit(ctx, r, id, http.StatusUnauthorized)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="hokuchi"`)
+				writeJSON(w, r, http.StatusUnauthorized, apiError{Error: http.StatusText(http.StatusUnauthorized)})
+				return
+			}
+			if id.Role < need {
+				s.audit(ctx, r, id, http.StatusForbidden)
+				writeJSON(w, r, http.StatusForbidden, apiError{Error: "role " + id.Role.String() + " may not " + r.Method})
+				return
+			}
+			ctx = context.WithValue(ctx, identityKey{}, id)
+		}
+
+		if need == RoleRead {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.audit(ctx, r, id, status)
+	})
+}
+
+func (s *Server) audit(ctx context.Context, r *http.Request, id Identity, status int) {
+	route := r.URL.Path
+	if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+		route = rctx.RoutePattern()
+	}
+	s.logger().InfoContext(ctx, "audit",
+		slog.Group("audit",
+			slog.String("caller", id.Name),
+			slog.String("auth", id.Method),
+			slog.String("role", id.Role.String()),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("route", route),
+			slog.Int("status", status),
+			slog.String("remote", sourceIP(r)),
+		),
+	)
+}
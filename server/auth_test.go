@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestRequireRole(t *testing.T) {
+	auth := NewAuthenticator(
+		[]Token{{Name: "ci", Role: RoleRead, Token: "read-token"}, {Name: "ops", Role: RoleWrite, Token: "write-token"}},
+		map[string]Role{"admin.example.com": RoleWrite},
+	)
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		// cn presents a verified client certificate with that common name
+		cn         string
+		wantStatus int
+		// wantAudit is the caller of the audit entry, or nil if no entry is expected
+		wantAudit *string
+	}{
+		{name: "anonymous read", method: "GET", wantStatus: http.StatusUnauthorized, wantAudit: ptr("")},
+		{name: "unknown token", method: "GET", token: "guess", wantStatus: http.StatusUnauthorized, wantAudit: ptr("")},
+		{name: "read", method: "GET", token: "read-token", wantStatus: http.StatusNoContent},
+		{name: "write with read role", method: "PUT", token: "read-token", wantStatus: http.StatusForbidden, wantAudit: ptr("ci")},
+		{name: "read with write role", method: "GET", token: "write-token", wantStatus: http.StatusNoContent},
+		{name: "write", method: "PUT", token: "write-token", wantStatus: http.StatusNoContent, wantAudit: ptr("ops")},
+		{name: "delete", method: "DELETE", token: "write-token", wantStatus: http.StatusNoContent, wantAudit: ptr("ops")},
+		{name: "client certificate", method: "POST", cn: "admin.example.com", wantStatus: http.StatusNoContent, wantAudit: ptr("admin.example.com")},
+		{name: "unknown client certificate", method: "GET", cn: "other.example.com", wantStatus: http.StatusUnauthorized, wantAudit: ptr("")},
+		// a bearer token is not overridden by a certificate with a stronger role
+		{name: "token before certificate", method: "PUT", token: "read-token", cn: "admin.example.com", wantStatus: http.StatusForbidden, wantAudit: ptr("ci")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			s := &Server{Auth: auth, Logger: slog.New(slog.NewJSONHandler(&logs, nil))}
+			router := chi.NewRouter()
+			router.Use(s.requireRole)
+			router.HandleFunc("/profiles/{id}", func(w http.ResponseWriter, r *http.Request) {
+				if _, ok := IdentityFromContext(r.Context()); !ok {
+					t.Error("no identity in the context")
+				}
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			r := httptest.NewRequest(tt.method, "/profiles/web", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.cn != "" {
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: tt.cn}}}}}
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			var entry struct {
+				Msg   string
+				Audit struct {
+					Caller string
+					Method string
+					Route  string
+					Status int
+				}
+			}
+			if tt.wantAudit == nil {
+				if logs.Len() != 0 {
+					t.Errorf("unexpected log: %s", logs.String())
+				}
+				return
+			}
+			if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+				t.Fatalf("audit entry %q: %v", logs.String(), err)
+			}
+			a := entry.Audit
+			if entry.Msg != "audit" || a.Caller != *tt.wantAudit || a.Method != tt.method || a.Status != tt.wantStatus {
+				t.Errorf("audit entry %s", logs.String())
+			}
+			if tt.wantStatus == http.StatusNoContent && a.Route != "/profiles/{id}" {
+				t.Errorf("audit route = %q, want the route pattern", a.Route)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorReplaceTokens(t *testing.T) {
+	auth := NewAuthenticator([]Token{{Name: "old", Role: RoleWrite, Token: "old-token"}}, nil)
+	auth.SetTokens([]Token{{Name: "new", Role: RoleRead, Token: "new-token"}})
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer old-token")
+	if id, ok := auth.Authenticate(r); ok {
+		t.Errorf("replaced token still authenticates %+v", id)
+	}
+	r.Header.Set("Authorization", "Bearer new-token")
+	if id, ok := auth.Authenticate(r); !ok || id.Name != "new" || id.Role != RoleRead || id.Method != "token" {
+		t.Errorf("Authenticate() = %+v, %v", id, ok)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
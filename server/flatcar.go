@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -8,13 +9,52 @@ import (
 	"net/http"
 	"strconv"
 
+	"braces.dev/errtrace"
+	"github.com/go-chi/chi/v5"
+	"github.com/tosuke/hokuchi/flatcar"
+	"github.com/tosuke/hokuchi/inventory"
+	"github.com/tosuke/hokuchi/profile"
 	"github.com/tosuke/hokuchi/slogerr"
 	"github.com/tosuke/hokuchi/storage"
 )
 
+type flatcarArtifact struct {
+	name  string
+	event inventory.EventType
+	key   func(flatcar.Key) string
+	fetch func(*flatcar.Fetcher, context.Context, io.Writer, flatcar.Key) error
+}
+
+var (
+	flatcarKernel = flatcarArtifact{
+		name:  "kernel",
+		event: inventory.EventKernel,
+		key:   flatcar.Key.KernelKey,
+		fetch: (*flatcar.Fetcher).FetchKernel,
+	}
+	flatcarInitrd = flatcarArtifact{
+		name:  "initrd",
+		event: inventory.EventInitrd,
+		key:   flatcar.Key.InitrdKey,
+		fetch: (*flatcar.Fetcher).FetchInitrd,
+	}
+)
+
 func (s *Server) HandleFlatcarKernel(w http.ResponseWriter, r *http.Request) {
+	s.serveFlatcarArtifact(w, r, flatcarKernel)
+}
+
+func (s *Server) HandleFlatcarInitrd(w http.ResponseWriter, r *http.Request) {
+	s.serveFlatcarArtifact(w, r, flatcarInitrd)
+}
+
+func (s *Server) serveFlatcarArtifact(w http.ResponseWriter, r *http.Request, artifact flatcarArtifact) {
 	ctx := r.Context()
-	profile := defaultProfile
+	profile, ok := s.Profiles.Rendered(chi.URLParam(r, "pid"))
+	if !ok {
+		http.Error(w, "profile not found", http.StatusNotFound)
+		return
+	}
 
 	fc := profile.Boot.Flatcar
 	if fc == nil {
@@ -22,77 +62,143 @@ func (s *Server) HandleFlatcarKernel(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	key, err := s.Flatcar.ResolveKey(ctx, fc.Channel, profile.Arch, fc.Version)
+	key, err := s.resolveFlatcar(ctx, profile)
 	if err != nil {
 		slog.ErrorContext(ctx, "Error resolving flatcar version", slogerr.Err(err))
-		w.WriteHeader(http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		http.Error(w, http.StatusText(status), status)
 		return
 	}
 
-	size, reader, err := s.Storage.Get(ctx, key.KernelKey())
+	size, reader, err := s.Storage.Get(ctx, artifact.key(key))
+	if errors.Is(err, storage.ErrNotfound) || errors.Is(err, storage.ErrCorrupted) {
+		// start downloading, again if the stored copy was corrupted and quarantined,
+		// and stream it to the client as it arrives
+		s.startFlatcarFetch(ctx, key, artifact)
+		size, reader, err = s.Storage.Get(ctx, artifact.key(key))
+	}
 	if err != nil {
 		if errors.Is(err, storage.ErrNotfound) {
-			http.Error(w, fmt.Sprintf("flatcar kernel %s not found", key.String()), http.StatusNotFound)
+			http.Error(w, fmt.Sprintf("flatcar %s %s not found", artifact.name, key.String()), http.StatusNotFound)
 			return
 		}
-		slog.ErrorContext(ctx, "Error getting kernel from storage", slogerr.Err(err))
+		slog.ErrorContext(ctx, fmt.Sprintf("Error getting %s from storage", artifact.name), slogerr.Err(err))
 		status := http.StatusInternalServerError
 		http.Error(w, http.StatusText(status), status)
 		return
 	}
+	defer reader.Close()
+	s.Storage.Touch(ctx, artifact.key(key))
 
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
-	w.Header().Set("Content-Disposition", "kernel")
-	if _, err := io.Copy(w, reader); err != nil {
-		slog.ErrorContext(ctx, "Error writing kernel response", slogerr.Err(err))
-		return
-	}
-	if err == nil {
+	if size >= 0 {
 		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
-		io.Copy(w, reader)
-		return
-	} else if !errors.Is(err, storage.ErrNotfound) {
-		slog.ErrorContext(ctx, "Error getting kernel from storage", slogerr.Err(err))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
 	}
+	w.Header().Set("Content-Disposition", artifact.name)
+	mid := r.URL.Query().Get(machineIDParam)
+	n, err := io.Copy(w, reader)
+	s.Metrics.AddArtifactBytes(artifact.name, n)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("Error writing %s response", artifact.name), slogerr.Err(err))
+		s.recordEvent(r, mid, artifact.event, profile.ID, err)
+		// abort the connection so that a partial download is not mistaken for a complete one
+		panic(http.ErrAbortHandler)
+	}
+	s.recordEvent(r, mid, artifact.event, profile.ID, nil)
 }
 
-func (s *Server) HandleFlatcarInitrd(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-
-	profile := defaultProfile
-	fc := profile.Boot.Flatcar
-	if fc == nil {
-		http.Error(w, "profile does not use flatcar", http.StatusBadRequest)
-		return
+func (s *Server) resolveFlatcar(ctx context.Context, p profile.Profile) (flatcar.Key, error) {
+	fc := p.Boot.Flatcar
+	key, err := s.Flatcar.ResolveKey(ctx, fc.Channel, p.Arch, fc.Version)
+	if err != nil {
+		if errors.Is(err, flatcar.ErrBadSignature) {
+			s.Metrics.SignatureFailure()
+		}
+		return flatcar.Key{}, errtrace.Wrap(err)
 	}
+	return key, nil
+}
 
-	key, err := s.Flatcar.ResolveKey(ctx, fc.Channel, profile.Arch, fc.Version)
+// startFlatcarFetch downloads an artifact into storage in the background unless it is already stored or being stored.
+func (s *Server) startFlatcarFetch(ctx context.Context, key flatcar.Key, artifact flatcarArtifact) {
+	storageKey := artifact.key(key)
+	tx, err := s.Storage.Add(ctx, storageKey)
 	if err != nil {
-		slog.ErrorContext(ctx, "Error resolving flatcar version", slogerr.Err(err))
-		status := http.StatusInternalServerError
-		http.Error(w, http.StatusText(status), status)
+		if !errors.Is(err, storage.ErrExists) {
+			slog.ErrorContext(ctx, "Error adding to storage", slog.String("key", storageKey), slogerr.Err(err))
+		}
 		return
 	}
 
-	size, reader, err := s.Storage.Get(ctx, key.InitrdKey())
-	if err != nil {
-		if errors.Is(err, storage.ErrNotfound) {
-			http.Error(w, fmt.Sprintf("flatcar initrd %s not found", key.String()), http.StatusNotFound)
+	ctx = context.WithoutCancel(ctx)
+	done := s.Metrics.FetchStarted(artifact.name)
+	go func() {
+		slog.InfoContext(ctx, fmt.Sprintf("fetching flatcar %s", artifact.name), slog.String("key", storageKey))
+		err := artifact.fetch(s.Flatcar, ctx, tx, key)
+		done(err, errors.Is(err, flatcar.ErrBadSignature))
+		if err != nil {
+			slog.ErrorContext(ctx, fmt.Sprintf("Error fetching flatcar %s", artifact.name), slog.String("key", storageKey), slogerr.Err(err))
+			if err := tx.Rollback(); err != nil {
+				slog.ErrorContext(ctx, "Error rolling back storage", slog.String("key", storageKey), slogerr.Err(err))
+			}
 			return
 		}
-		slog.ErrorContext(ctx, "Error getting initrd from storage", slogerr.Err(err))
-		http.Error(w, "Internal Error from storage", http.StatusInternalServerError)
-		return
+		// a failed commit rolls itself back
+		if err := tx.Commit(ctx); err != nil {
+			slog.ErrorContext(ctx, "Error committing storage", slog.String("key", storageKey), slogerr.Err(err))
+			return
+		}
+		slog.InfoContext(ctx, fmt.Sprintf("fetched flatcar %s", artifact.name), slog.String("key", storageKey))
+	}()
+}
+
+// prepareFlatcar makes sure the kernel and initrd are stored or being stored, and reports whether both can be served.
+func (s *Server) prepareFlatcar(ctx context.Context, key flatcar.Key) bool {
+	ready := true
+	for _, artifact := range []flatcarArtifact{flatcarKernel, flatcarInitrd} {
+		s.startFlatcarFetch(ctx, key, artifact)
+
+		_, reader, err := s.Storage.Get(ctx, artifact.key(key))
+		if err != nil {
+			if !errors.Is(err, storage.ErrNotfound) {
+				slog.ErrorContext(ctx, fmt.Sprintf("Error getting %s from storage", artifact.name), slogerr.Err(err))
+			}
+			ready = false
+			continue
+		}
+		reader.Close()
 	}
+	return ready
+}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
-	w.Header().Set("Content-Disposition", "initrd")
-	if _, err := io.Copy(w, reader); err != nil {
-		slog.ErrorContext(ctx, "Error writing initrd response", slogerr.Err(err))
-		return
+// Prefetch starts downloading the artifacts of every profile that are not stored yet.
+func (s *Server) Prefetch(ctx context.Context) {
+	for _, p := range s.Profiles.RenderedProfiles() {
+		fc := p.Boot.Flatcar
+		if fc == nil {
+			continue
+		}
+		key, err := s.resolveFlatcar(ctx, p)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error resolving flatcar version", slog.String("profile", p.ID), slogerr.Err(err))
+			continue
+		}
+		s.prepareFlatcar(ctx, key)
+	}
+}
+
+// PinnedArtifacts lists the storage keys of the artifacts used by any profile. It does not contact the mirror,
+// so the artifacts of a "current" version are only listed once that version has been resolved.
+func (s *Server) PinnedArtifacts() []string {
+	var keys []string
+	for _, p := range s.Profiles.RenderedProfiles() {
+		fc := p.Boot.Flatcar
+		if fc == nil {
+			continue
+		}
+		if fkey, ok := s.Flatcar.KnownKey(fc.Channel, p.Arch, fc.Version); ok {
+			keys = append(keys, flatcarKernel.key(fkey), flatcarInitrd.key(fkey))
+		}
 	}
+	return keys
 }
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi/profile"
+)
+
+// readyTimeout bounds the checks of a single readiness probe, most notably the mirror lookup.
+const readyTimeout = 5 * time.Second
+
+var bootArches = []string{"amd64", "arm64"}
+
+type healthStatus struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+type healthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+func newHealthCheck(err error) healthCheck {
+	if err != nil {
+		return healthCheck{Error: err.Error()}
+	}
+	return healthCheck{OK: true}
+}
+
+// HandleHealthz reports that the process is alive and serving requests.
+func (s *Server) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+// HandleReadyz reports whether every dependency needed to boot machines is available.
+func (s *Server) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	checks := map[string]healthCheck{
+		"storage":  newHealthCheck(s.checkStorage(ctx)),
+		"assets":   newHealthCheck(s.checkAssets()),
+		"profiles": newHealthCheck(s.checkProfiles()),
+		"mirror":   newHealthCheck(s.checkMirror(ctx)),
+	}
+
+	res := healthStatus{Status: "ok", Checks: checks}
+	status := http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			res.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+			break
+		}
+	}
+	writeJSON(w, r, status, res)
+}
+
+func (s *Server) checkStorage(ctx context.Context) error {
+	if s.Storage == nil {
+		return errtrace.New("storage not configured")
+	}
+	return errtrace.Wrap(s.Storage.Check(ctx))
+}
+
+func (s *Server) checkAssets() error {
+	var errs []error
+	for _, arch := range bootArches {
+		path := filepath.Join(s.AssetsPath, "boot_"+arch+".efi")
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errtrace.Wrap(errors.Join(errs...))
+}
+
+func (s *Server) checkProfiles() error {
+	if s.Profiles == nil || len(s.Profiles.RenderedProfiles()) == 0 {
+		return errtrace.New("no profiles loaded")
+	}
+	return nil
+}
+
+// checkMirror makes sure the version of every Flatcar profile can be resolved,
+// either from the mirror or from a previously resolved version.
+func (s *Server) checkMirror(ctx context.Context) error {
+	if s.Profiles == nil {
+		return nil
+	}
+	var errs []error
+	for _, p := range s.Profiles.RenderedProfiles() {
+		if err := s.checkProfileMirror(ctx, p); err != nil {
+			errs = append(errs, errtrace.Errorf("profile %s: %w", p.ID, err))
+		}
+	}
+	return errtrace.Wrap(errors.Join(errs...))
+}
+
+func (s *Server) checkProfileMirror(ctx context.Context, p profile.Profile) error {
+	fc := p.Boot.Flatcar
+	if fc == nil {
+		return nil
+	}
+	_, err := s.resolveFlatcar(ctx, p)
+	if err == nil {
+		return nil
+	}
+	if _, ok := s.Flatcar.LastVersion(fc.Channel, p.Arch); ok {
+		return nil
+	}
+	return errtrace.Wrap(err)
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"braces.dev/errtrace"
+	"github.com/go-chi/chi/v5"
+	"github.com/tosuke/hokuchi/inventory"
+	"github.com/tosuke/hokuchi/profile"
+	"github.com/tosuke/hokuchi/secret"
+	"github.com/tosuke/hokuchi/slogerr"
+	"golang.org/x/sync/errgroup"
+)
+
+func (s *Server) HandleIgnition(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	profile, ok := s.Profiles.Rendered(chi.URLParam(r, "pid"))
+	if !ok {
+		http.Error(w, "profile not found", http.StatusNotFound)
+		return
+	}
+	mid := r.URL.Query().Get(machineIDParam)
+
+	ign := profile.Ignition
+	if !ign.Configured() {
+		http.Error(w, "profile has no ignition config", http.StatusNotFound)
+		return
+	}
+	if ign.Source != "" && ign.OneTime {
+		// only stored before such profiles were rejected; a redirect cannot be served once
+		slog.ErrorContext(ctx, "refusing one-time ignition with a source", slog.String("profile", profile.ID))
+		http.Error(w, "one-time ignition cannot use a source", http.StatusInternalServerError)
+		return
+	}
+	if ign.Source != "" {
+		source, err := s.Secrets.Expand(ign.Source)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error resolving ignition secrets", slog.String("profile", profile.ID), slogerr.Err(err))
+			http.Error(w, "profile references an unavailable secret", http.StatusInternalServerError)
+			s.recordEvent(r, mid, inventory.EventIgnition, profile.ID, err)
+			return
+		}
+		http.Redirect(w, r, source, http.StatusFound)
+		s.recordEvent(r, mid, inventory.EventIgnition, profile.ID, nil)
+		return
+	}
+
+	config, err := s.buildIgnition(ctx, ign, mid)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error building ignition config", slog.String("profile", profile.ID), slogerr.Err(err))
+		message := "cannot compose ignition config"
+		if errors.Is(err, secret.ErrNotFound) || errors.Is(err, secret.ErrInvalidName) {
+			message = "profile references an unavailable secret"
+		}
+		http.Error(w, message, http.StatusInternalServerError)
+		s.recordEvent(r, mid, inventory.EventIgnition, profile.ID, err)
+		return
+	}
+
+	// the token is only spent once there is a config to hand over
+	if ign.OneTime {
+		if err := s.consumeProvisioningToken(ctx, mid, r.URL.Query().Get(provisioningTokenParam)); err != nil {
+			status := http.StatusForbidden
+			if errors.Is(err, inventory.ErrTokenConsumed) {
+				status = http.StatusGone
+			}
+			slog.WarnContext(ctx, "rejected ignition request", slog.String("machine", mid), slogerr.Err(err))
+			http.Error(w, http.StatusText(status), status)
+			s.recordEvent(r, mid, inventory.EventIgnition, profile.ID, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write([]byte(config))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error writing ignition response", slogerr.Err(err))
+	}
+	s.recordEvent(r, mid, inventory.EventIgnition, profile.ID, err)
+}
+
+// buildIgnition returns the config served for ign, which must not use a source.
+func (s *Server) buildIgnition(ctx context.Context, ign profile.Ignition, machineID string) (string, error) {
+	if len(ign.Fragments) > 0 {
+		return errtrace.Wrap2(s.composeIgnition(ctx, ign, machineID))
+	}
+	return errtrace.Wrap2(s.Secrets.ExpandJSON(ign.Inline))
+}
+
+// maxFragmentSize bounds the ignition fragments fetched from their source.
+const maxFragmentSize = 1 << 20
+
+const (
+	// fragmentTimeout bounds fetching all the fragments of one config.
+	fragmentTimeout = 10 * time.Second
+	// fragmentCacheTTL is how long a fetched fragment is reused before it is fetched again.
+	fragmentCacheTTL = time.Minute
+)
+
+type cachedFragment struct {
+	data    string
+	fetched time.Time
+}
+
+// composeIgnition merges the fragments of ign that apply to the machine into one config,
+// fetching those given by source, and resolves the secrets it references.
+func (s *Server) composeIgnition(ctx context.Context, ign profile.Ignition, machineID string) (string, error) {
+	// without a known machine, only fragments for every machine apply
+	var machine profile.Machine
+	if machineID != "" && s.Inventory != nil {
+		m, err := s.Inventory.Get(ctx, machineID)
+		if err != nil && !errors.Is(err, inventory.ErrNotFound) {
+			return "", errtrace.Wrap(err)
+		}
+		machine = m.Machine
+	}
+
+	var fragments []string
+	ctx, cancel := context.WithTimeout(ctx, fragmentTimeout)
+	defer cancel()
+	eg, egctx := errgroup.WithContext(ctx)
+	for _, f := range ign.Fragments {
+		if !f.Selector.Matches(machine) {
+			continue
+		}
+		if f.Inline != "" {
+			fragments = append(fragments, f.Inline)
+			continue
+		}
+		source, err := s.Secrets.Expand(f.Source)
+		if err != nil {
+			return "", errtrace.Wrap(err)
+		}
+		// fetched concurrently, and filled in at the fragment's place
+		i := len(fragments)
+		fragments = append(fragments, "")
+		name := f.Name
+		eg.Go(func() error {
+			data, err := s.fragment(egctx, source)
+			if err != nil {
+				// the source may carry a secret, so only the fragment name is reported
+				return errtrace.Errorf("fetching ignition fragment %q: %w", name, err)
+			}
+			fragments[i] = data
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return "", errtrace.Wrap(err)
+	}
+	config, err := profile.ComposeIgnition(ign.Inline, fragments)
+	if err != nil {
+		return "", errtrace.Wrap(err)
+	}
+	return errtrace.Wrap2(s.Secrets.ExpandJSON(config))
+}
+
+// fragment returns the fragment at source, fetching it unless it was fetched recently.
+func (s *Server) fragment(ctx context.Context, source string) (string, error) {
+	if c, ok := s.fragments.Load(source); ok && time.Since(c.fetched) < fragmentCacheTTL {
+		return c.data, nil
+	}
+	data, err := fetchFragment(ctx, source)
+	if err != nil {
+		return "", errtrace.Wrap(err)
+	}
+	s.fragments.Store(source, cachedFragment{data: data, fetched: time.Now()})
+	return data, nil
+}
+
+func fetchFragment(ctx context.Context, source string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return "", errtrace.New("invalid source url")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return "", errtrace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errtrace.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFragmentSize+1))
+	if err != nil {
+		return "", errtrace.Wrap(err)
+	}
+	if len(data) > maxFragmentSize {
+		return "", errtrace.Errorf("fragment exceeds %d bytes", maxFragmentSize)
+	}
+	return string(data), nil
+}
+
+// provisioningTokenParam carries the one-time token of profiles with Ignition.OneTime.
+const provisioningTokenParam = "token"
+
+// mintProvisioningToken returns a fresh token for the machine, or an empty string if its
+// token has already been consumed and the machine is waiting to be re-armed.
+func (s *Server) mintProvisioningToken(ctx context.Context, machineID, profileID string) (string, error) {
+	if machineID == "" || s.Inventory == nil {
+		// nothing to bind the token to; ignition will be refused
+		return "", nil
+	}
+	token, err := s.Inventory.MintToken(ctx, machineID, profileID)
+	if err != nil {
+		if errors.Is(err, inventory.ErrTokenConsumed) {
+			return "", nil
+		}
+		return "", errtrace.Wrap(err)
+	}
+	return token, nil
+}
+
+func (s *Server) consumeProvisioningToken(ctx context.Context, machineID, token string) error {
+	if machineID == "" || token == "" || s.Inventory == nil {
+		return errtrace.Wrap(inventory.ErrTokenInvalid)
+	}
+	return errtrace.Wrap(s.Inventory.ConsumeToken(ctx, machineID, token))
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/tosuke/hokuchi/inventory"
+	"github.com/tosuke/hokuchi/profile"
+	"github.com/tosuke/hokuchi/secret"
+	"github.com/tosuke/hokuchi/state"
+)
+
+func TestOneTimeIgnition(t *testing.T) {
+	ctx := context.Background()
+	db, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	profiles := profile.NewRegistry()
+	if _, err := profiles.CreateProfile(profile.Profile{
+		ID:       "web",
+		Arch:     "amd64",
+		Boot:     profile.Boot{Flatcar: &profile.Flatcar{Channel: "stable", Version: "current"}},
+		Ignition: profile.Ignition{Inline: `{"passwd":{"users":[{"name":"core","sshAuthorizedKeys":["${secret:test-sshkey}"]}]}}`, OneTime: true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Profiles: profiles, Inventory: inventory.New(db), Secrets: &secret.Store{}}
+	m, err := s.Inventory.Record(ctx, inventory.Sighting{Machine: profile.Machine{MAC: "52:54:00:00:00:01"}, NewBoot: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.mintProvisioningToken(ctx, m.ID, "web")
+	if err != nil || token == "" {
+		t.Fatalf("mintProvisioningToken() = %q, %v", token, err)
+	}
+
+	router := chi.NewRouter()
+	router.Get("/profile/{pid}/ignition", s.HandleIgnition)
+	get := func(token string) int {
+		q := url.Values{machineIDParam: {m.ID}, provisioningTokenParam: {token}}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/profile/web/ignition?"+q.Encode(), nil))
+		return w.Code
+	}
+
+	if code := get(token); code != http.StatusInternalServerError {
+		t.Fatalf("with a missing secret: status = %d, want %d", code, http.StatusInternalServerError)
+	}
+	// the failed attempt must not have spent the token
+	t.Setenv(secret.EnvPrefix+"TEST_SSHKEY", "ssh-ed25519 AAAA core")
+	if code := get("wrong"); code != http.StatusForbidden {
+		t.Fatalf("with a wrong token: status = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := get(token); code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", code, http.StatusOK)
+	}
+	if code := get(token); code != http.StatusGone {
+		t.Fatalf("second fetch: status = %d, want %d", code, http.StatusGone)
+	}
+}
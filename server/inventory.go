@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"braces.dev/errtrace"
+	"github.com/go-chi/chi/v5"
+	"github.com/tosuke/hokuchi/inventory"
+	"github.com/tosuke/hokuchi/profile"
+	"github.com/tosuke/hokuchi/slogerr"
+)
+
+func (s *Server) recordMachine(r *http.Request, machine profile.Machine, profileID string, attempt int, newBoot bool) {
+	if s.Inventory == nil || inventory.MachineID(machine) == "" {
+		return
+	}
+	ctx := r.Context()
+	_, err := s.Inventory.Record(ctx, inventory.Sighting{
+		Machine:   machine,
+		SourceIP:  sourceIP(r),
+		ProfileID: profileID,
+		NewBoot:   newBoot,
+		Attempt:   attempt,
+		Discovery: s.Discovery,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error recording machine", slogerr.Err(err))
+	}
+}
+
+// lookupMachine returns the inventory record of machine, or a zero Machine if it is unknown.
+func (s *Server) lookupMachine(r *http.Request, machine profile.Machine) inventory.Machine {
+	id := inventory.MachineID(machine)
+	if s.Inventory == nil || id == "" {
+		return inventory.Machine{}
+	}
+	ctx := r.Context()
+	m, err := s.Inventory.Get(ctx, id)
+	if err != nil && !errors.Is(err, inventory.ErrNotFound) {
+		slog.ErrorContext(ctx, "Error getting machine", slogerr.Err(err))
+	}
+	return m
+}
+
+// holdParam marks the requests of a machine polling for its approval.
+const holdParam = "hold"
+
+// holdMachine keeps a machine awaiting approval in a polling loop. Machines that cannot be
+// identified could never be approved, so they are turned away instead.
+func (s *Server) holdMachine(w http.ResponseWriter, r *http.Request, machine profile.Machine) {
+	ctx := r.Context()
+	id := inventory.MachineID(machine)
+	if id == "" {
+		if err := renderIPXEError(w, http.StatusForbidden, "machine cannot be identified for approval"); err != nil {
+			slog.ErrorContext(ctx, "Error writing ipxe response", slogerr.Err(err))
+		}
+		return
+	}
+	newBoot := r.URL.Query().Get(holdParam) == ""
+	s.recordMachine(r, machine, "", 0, newBoot)
+	if newBoot {
+		slog.InfoContext(ctx, "holding machine pending approval", slog.String("machine", id), slog.String("source_ip", sourceIP(r)))
+	}
+
+	interval := int(max(s.DiscoveryInterval, time.Second) / time.Second)
+	message := fmt.Sprintf("Machine %s is pending approval, checking again in %ds...", id, interval)
+	if err := renderRetryIPXE(w, r, message, interval, holdParam, "1"); err != nil {
+		slog.ErrorContext(ctx, "Error writing hold ipxe response", slogerr.Err(err))
+	}
+}
+
+// recordEvent appends a boot event to the history of a machine known to the inventory.
+func (s *Server) recordEvent(r *http.Request, machineID string, typ inventory.EventType, profileID string, eventErr error) {
+	if s.Inventory == nil || machineID == "" {
+		return
+	}
+	ctx := r.Context()
+	e := inventory.Event{
+		MachineID: machineID,
+		Type:      typ,
+		ProfileID: profileID,
+		SourceIP:  sourceIP(r),
+	}
+	if eventErr != nil {
+		e.Error = eventErr.Error()
+	}
+	if err := s.Inventory.RecordEvent(context.WithoutCancel(ctx), e); err != nil {
+		if errors.Is(err, inventory.ErrNotFound) {
+			slog.DebugContext(ctx, "ignoring event of unknown machine", slog.String("machine", machineID))
+			return
+		}
+		slog.ErrorContext(ctx, "Error recording boot event", slogerr.Err(err))
+	}
+}
+
+// HandleBooted records that a machine came up. Its URL is signed for the machine and passed
+// to the booted system as the hokuchi.booted_url kernel argument.
+func (s *Server) HandleBooted(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	mid := chi.URLParam(r, "mid")
+	if r.URL.Query().Get(machineIDParam) != mid {
+		// the signature only covers the machine ID in the query
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	m, err := s.Inventory.Get(ctx, mid)
+	if err != nil {
+		if errors.Is(err, inventory.ErrNotFound) {
+			http.Error(w, "machine not found", http.StatusNotFound)
+			return
+		}
+		slog.ErrorContext(ctx, "Error getting machine", slogerr.Err(err))
+		status := http.StatusInternalServerError
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	s.recordEvent(r, mid, inventory.EventBooted, m.ProfileID, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) HandleMachineEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	mid := chi.URLParam(r, "id")
+	if _, err := s.Inventory.Get(ctx, mid); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	events, err := s.Inventory.Events(ctx, mid)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, events)
+}
+
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// HandleListMachines lists the inventory, only the machines with the given status if ?status= is set.
+func (s *Server) HandleListMachines(w http.ResponseWriter, r *http.Request) {
+	ms, err := s.Inventory.List(r.Context())
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if status := r.URL.Query().Get("status"); status != "" {
+		ms = slices.DeleteFunc(ms, func(m inventory.Machine) bool { return m.Status != status })
+	}
+	if ms == nil {
+		ms = []inventory.Machine{}
+	}
+	writeJSON(w, r, http.StatusOK, ms)
+}
+
+func (s *Server) HandleGetMachine(w http.ResponseWriter, r *http.Request) {
+	m, err := s.Inventory.Get(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, m)
+}
+
+func (s *Server) HandleMachineProvisioning(w http.ResponseWriter, r *http.Request) {
+	p, err := s.Inventory.Provisioning(r.Context(), chi.URLParam(r, "id"))
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	p.TokenHash = ""
+	writeJSON(w, r, http.StatusOK, p)
+}
+
+// HandleRearmMachine lets a machine retrieve its one-time ignition config again.
+func (s *Server) HandleRearmMachine(w http.ResponseWriter, r *http.Request) {
+	if err := s.Inventory.Rearm(r.Context(), chi.URLParam(r, "id")); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type approveRequest struct {
+	// ProfileID assigns the machine a profile. When empty, the current assignment is kept.
+	ProfileID string `json:"profileId,omitempty"`
+	// Unassign removes the current assignment, so that groups choose the profile as usual.
+	Unassign bool `json:"unassign,omitempty"`
+}
+
+// HandleApproveMachine lets a machine held in discovery mode boot, optionally changing its assigned profile.
+func (s *Server) HandleApproveMachine(w http.ResponseWriter, r *http.Request) {
+	var req approveRequest
+	if r.ContentLength != 0 {
+		if err := readJSON(r, &req); err != nil {
+			writeAPIError(w, r, err)
+			return
+		}
+	}
+	id := chi.URLParam(r, "id")
+	if req.ProfileID == "" {
+		m, err := s.Inventory.Approve(r.Context(), id, inventory.Assignment{Clear: req.Unassign})
+		if err != nil {
+			writeAPIError(w, r, err)
+			return
+		}
+		writeJSON(w, r, http.StatusOK, m)
+		return
+	}
+	if req.Unassign {
+		writeAPIError(w, r, errtrace.Errorf("%w: profileId and unassign are exclusive", profile.ErrInvalid))
+		return
+	}
+	var m inventory.Machine
+	// the profile cannot be deleted until the assignment is stored
+	err := s.Profiles.WithProfile(req.ProfileID, func(profile.Profile) error {
+		var err error
+		m, err = s.Inventory.Approve(r.Context(), id, inventory.Assignment{ProfileID: req.ProfileID})
+		return errtrace.Wrap(err)
+	})
+	if errors.Is(err, profile.ErrNotFound) {
+		err = errtrace.Errorf("%w: profile %q does not exist", profile.ErrInvalid, req.ProfileID)
+	}
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, m)
+}
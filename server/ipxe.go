@@ -2,16 +2,22 @@ package server
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"log/slog"
-	"math"
 	"math/rand"
 	"net/http"
+	"net/url"
+	"slices"
 	"strconv"
 	"text/template"
+	"time"
 
 	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi"
+	"github.com/tosuke/hokuchi/inventory"
 	"github.com/tosuke/hokuchi/profile"
+	"github.com/tosuke/hokuchi/secret"
 	"github.com/tosuke/hokuchi/slogerr"
 )
 
@@ -26,62 +32,357 @@ initrd {{if ne $image.Name ""}} --name {{$image.Name}}{{end}} {{$image.URI}}
 {{- end}}
 boot`))
 
+var ipxeMenuTemplate = template.Must(template.New("menu").Parse(`#!ipxe
+menu {{.Title}}
+{{- range .Items}}
+item {{.ID}} {{.Label}}
+{{- end}}
+choose --default {{.Default}} --timeout {{.TimeoutMs}} target || set target {{.Default}}
+chain --replace {{.ChainURL}}${target}
+`))
+
 func (s *Server) HandleBootstrapIPXE(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.Write([]byte(bootstrapIpxe))
 }
 
-var defaultProfile = profile.Profile{
-	ID: "default",
-	Arch: "arm64",
-	Boot: profile.Boot{
-		Flatcar: &profile.Flatcar{
-			Channel: "beta",
-			Version: "current",
-			Args: []string{
-				"flatcar.firstboot=1",
-				"sshkey=\"ecdsa-sha2-nistp384 AAAAE2VjZHNhLXNoYTItbmlzdHAzODQAAAAIbmlzdHAzODQAAABhBBW8gye009QtUJvF6by0Cmx91y0jRA5h0FGzurmazR6w9MSW702YFM/cXgsf3Au4y6kzRmUSpUDdm7QhRYM4yDsljmoyLZ2qz807sCakOaFhXmYrFeqbgQy2RveSeVT94A== tosuke\"",
-			},
-		},
-	},
-}
-
-const backoffBase = 10_000
-const backoffCap = 600_000
-
 func (s *Server) HandleIPXE(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	query := r.URL.Query()
 
 	var attempt int
 	if q := query.Get("attempt"); q != "" {
-		if v, err := strconv.ParseInt(q, 10, 0); err == nil {
+		if v, err := strconv.ParseInt(q, 10, 0); err == nil && v > 0 {
 			attempt = int(v)
 		}
 	}
 
+	machine := machineFromQuery(query)
+	record := s.lookupMachine(r, machine)
+	if s.Discovery && (record.ID == "" || record.Pending()) {
+		s.holdMachine(w, r, machine)
+		return
+	}
+
+	profile, group, ok := s.Profiles.Match(machine)
+	choice := query.Get(profileParam)
+	assigned := record.AssignedProfileID != ""
+	// noProfile explains why there is no profile to boot when !ok
+	var noProfile error
+	if assigned {
+		// an operator's assignment overrides the groups, with their menus, allowlists and retry policies
+		group = noGroup
+		profile, ok = s.Profiles.Rendered(record.AssignedProfileID)
+		switch {
+		case !ok:
+			noProfile = errtrace.Errorf("assigned profile %s does not exist", record.AssignedProfileID)
+		case machine.Arch != "" && profile.Arch != machine.Arch:
+			ok = false
+			noProfile = errtrace.Errorf("assigned profile %s is for %s, not %s", profile.ID, profile.Arch, machine.Arch)
+		}
+	} else if ok && choice != "" {
+		profile, ok = s.menuChoice(r, group, machine, choice)
+		if !ok {
+			slog.WarnContext(ctx, "rejected profile not offered by menu", slog.String("group", group.ID), slog.String("profile", choice))
+			denyIPXE(w, r)
+			return
+		}
+	}
+	if !ok && !assigned {
+		profile, noProfile = s.fallbackProfile(machine)
+		ok = noProfile == nil
+	}
+	// a menu choice or an approval continues the boot that was already recorded
+	newBoot := attempt == 0 && choice == "" && query.Get(holdParam) == ""
+	s.recordMachine(r, machine, profile.ID, attempt, newBoot)
+	if !ok {
+		slog.WarnContext(ctx, "no profile to boot", slog.String("machine", inventory.MachineID(machine)), slog.String("reason", noProfile.Error()))
+		if err := renderIPXEError(w, http.StatusNotFound, noProfile.Error()); err != nil {
+			slog.ErrorContext(ctx, "Error writing ipxe response", slogerr.Err(err))
+		}
+		return
+	}
+	if group.Menu != nil && !assigned && choice == "" && allowed(r, group.AllowedCIDRs) {
+		if err := s.renderMenuIPXE(w, r, group, machine); err != nil {
+			slog.ErrorContext(ctx, "Error writing ipxe menu response", slogerr.Err(err))
+		}
+		return
+	}
+	if !allowed(r, group.AllowedCIDRs) || !allowed(r, profile.AllowedCIDRs) {
+		slog.WarnContext(ctx, "rejected client outside allowlist", slog.String("group", group.ID), slog.String("profile", profile.ID), slog.String("source_ip", sourceIP(r)))
+		denyIPXE(w, r)
+		return
+	}
+
+	if fc := profile.Boot.Flatcar; fc != nil {
+		key, err := s.resolveFlatcar(ctx, profile)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error resolving flatcar version", slogerr.Err(err))
+		} else if s.prepareFlatcar(ctx, key) {
+			mid := inventory.MachineID(machine)
+			err := s.renderFlatcarIPXE(w, r, profile, mid)
+			if errors.Is(err, errRenderIPXE) {
+				slog.ErrorContext(ctx, "Error rendering ipxe script", slogerr.Err(err))
+			} else if err != nil {
+				slog.ErrorContext(ctx, "Error writing ipxe response", slogerr.Err(err))
+			}
+			s.recordEvent(r, mid, inventory.EventIPXE, profile.ID, err)
+			return
+		}
+	}
+
 	// retry
-	// Exponential Backoff And Equal Jitter
-	temp := min(backoffCap, backoffBase*int(math.Pow(2, float64(attempt))))
-	sleepMs := temp/2 + rand.Intn(temp/2)
-	sleep := (sleepMs + 500) / 1000
-	if err := renderRetryIPXE(w, r, sleep, attempt+1); err != nil {
+	policy := group.RetryPolicy()
+	if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+		slog.WarnContext(ctx, "giving up boot after maximum attempts", slog.String("machine", inventory.MachineID(machine)), slog.String("profile", profile.ID), slog.Int("attempts", attempt))
+		s.Metrics.IPXERetryExhausted()
+		s.recordEvent(r, inventory.MachineID(machine), inventory.EventIPXE, profile.ID, errRetryExhausted)
+		// served with 200 so that iPXE runs the script rather than failing the chain
+		err := renderIPXEFailure(w, http.StatusOK, "Giving up: boot artifacts are not ready", policy.OnExhausted)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error writing ipxe response", slogerr.Err(err))
+		}
+		return
+	}
+	sleep := backoff(policy, attempt)
+	s.Metrics.IPXERetry(attempt + 1)
+	if err := renderRetryIPXE(w, r, fmt.Sprintf("Retry after %ds...", sleep), sleep, "attempt", strconv.Itoa(attempt+1)); err != nil {
 		slog.ErrorContext(ctx, "Error writing retry ipxe response", slogerr.Err(err))
 	}
 	return
 }
 
-func renderRetryIPXE(w http.ResponseWriter, r *http.Request, sleep int, nextAttempt int) error {
+var errRetryExhausted = errtrace.New("retry attempts exhausted")
+
+// noGroup stands for the group of a machine whose profile was assigned by an operator.
+var noGroup profile.Group
+
+// backoff returns the seconds to wait before the next attempt,
+// using exponential backoff with equal jitter.
+func backoff(p profile.RetryPolicy, attempt int) int {
+	limit := time.Duration(min(max(p.CapSeconds, 0), profile.MaxRetrySeconds)) * time.Second
+	temp := time.Duration(min(max(p.BaseSeconds, 0), profile.MaxRetrySeconds)) * time.Second
+	// doubling stops at the cap, so that large attempts cannot overflow
+	for i := 0; i < attempt && temp > 0 && temp < limit; i++ {
+		temp *= 2
+	}
+	temp = max(min(temp, limit), 1)
+	sleep := temp/2 + time.Duration(rand.Int63n(int64(temp/2)+1))
+	return int(sleep.Round(time.Second) / time.Second)
+}
+
+// fallbackProfile returns the profile for the architecture of a machine no group matches.
+// The error explains to the operator at the console why there is none.
+func (s *Server) fallbackProfile(machine profile.Machine) (profile.Profile, error) {
+	if machine.Arch == "" {
+		return profile.Profile{}, errtrace.New("no profile matches this machine and it did not report its architecture")
+	}
+	id, ok := s.FallbackProfiles[machine.Arch]
+	if !ok {
+		return profile.Profile{}, errtrace.Errorf("no profile matches this machine and there is no fallback for %s", machine.Arch)
+	}
+	p, ok := s.Profiles.Rendered(id)
+	if !ok {
+		return profile.Profile{}, errtrace.Errorf("fallback profile %s for %s does not exist", id, machine.Arch)
+	}
+	return p, nil
+}
+
+func machineFromQuery(query url.Values) profile.Machine {
+	return profile.Machine{
+		UUID:     query.Get("uuid"),
+		MAC:      profile.NormalizeMAC(query.Get("mac")),
+		Serial:   query.Get("serial"),
+		Hostname: query.Get("hostname"),
+		Domain:   query.Get("domain"),
+		Arch:     hokuchi.NormalizeArch(query.Get("arch")),
+	}
+}
+
+type ipxeParams struct {
+	Kernel ipxeKernel
+	Images []ipxeImage
+}
+
+type ipxeKernel struct {
+	URI  string
+	Args []string
+}
+
+type ipxeImage struct {
+	Name string
+	URI  string
+}
+
+type ipxeMenuParams struct {
+	Title     string
+	Items     []ipxeMenuItem
+	Default   string
+	TimeoutMs int
+	// ChainURL is completed with the ID of the chosen profile.
+	ChainURL string
+}
+
+type ipxeMenuItem struct {
+	ID    string
+	Label string
+}
+
+// profileParam carries the profile chosen from a boot menu.
+const profileParam = "profile"
+
+// menuChoice returns the profile chosen from the menu of group, if the menu offers it to the machine.
+func (s *Server) menuChoice(r *http.Request, group profile.Group, machine profile.Machine, id string) (profile.Profile, bool) {
+	if group.Menu == nil || !slices.Contains(group.ProfileIDs(), id) {
+		return profile.Profile{}, false
+	}
+	p, ok := s.Profiles.Rendered(id)
+	if !ok || !menuOffers(r, p, machine) {
+		return profile.Profile{}, false
+	}
+	return p, true
+}
+
+// menuOffers reports whether a menu lists p, leaving out the profiles the machine could not boot.
+func menuOffers(r *http.Request, p profile.Profile, machine profile.Machine) bool {
+	if !allowed(r, p.AllowedCIDRs) {
+		return false
+	}
+	return machine.Arch == "" || p.Arch == machine.Arch
+}
+
+// renderMenuIPXE lets the operator pick one of the profiles offered by group and chains back with the choice.
+func (s *Server) renderMenuIPXE(w http.ResponseWriter, r *http.Request, group profile.Group, machine profile.Machine) error {
+	params := ipxeMenuParams{
+		Title:     "hokuchi: " + group.ID,
+		TimeoutMs: group.Menu.Timeout() * 1000,
+	}
+	for _, id := range group.ProfileIDs() {
+		p, ok := s.Profiles.Rendered(id)
+		if !ok || !menuOffers(r, p, machine) {
+			continue
+		}
+		label := p.ID
+		if fc := p.Boot.Flatcar; fc != nil {
+			label += " (flatcar " + fc.Channel + " " + fc.Version + ")"
+		}
+		params.Items = append(params.Items, ipxeMenuItem{ID: p.ID, Label: label})
+	}
+	if len(params.Items) == 0 {
+		denyIPXE(w, r)
+		return nil
+	}
+	params.Default = params.Items[0].ID
+
+	query := r.URL.Query()
+	query.Del(profileParam)
+	query.Del("attempt")
+	params.ChainURL = r.URL.Path + "?"
+	if len(query) > 0 {
+		params.ChainURL += query.Encode() + "&"
+	}
+	params.ChainURL += profileParam + "="
+
+	var b bytes.Buffer
+	if err := ipxeMenuTemplate.Execute(&b, params); err != nil {
+		return errtrace.Wrap(err)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := b.WriteTo(w); err != nil {
+		return errtrace.Wrap(err)
+	}
+	return nil
+}
+
+// errRenderIPXE marks the failures to build a boot script. An error script has been served instead.
+var errRenderIPXE = errtrace.New("cannot render ipxe script")
+
+// machineIDParam correlates requests for artifacts and ignition with the machine the script was rendered for.
+const machineIDParam = "mid"
+
+func (s *Server) renderFlatcarIPXE(w http.ResponseWriter, r *http.Request, p profile.Profile, machineID string) error {
+	// iPXE fetches the artifacts from the address it requested the script from, but the kernel
+	// fetches ignition and reports back with whatever address its initramfs has configured
+	ipxeURL := func(path string) string {
+		return s.signedURL(r, path, machineID, true)
+	}
+	systemURL := func(path string) string {
+		return baseURL(r) + s.signedURL(r, path, machineID, false)
+	}
+
+	base := "/profile/" + url.PathEscape(p.ID)
+	kernelArgs, err := s.Secrets.ExpandArgs(p.Boot.Flatcar.Args)
+	if err != nil {
+		message := "profile references an unavailable secret"
+		if errors.Is(err, secret.ErrInvalidValue) {
+			message = "profile references a secret that cannot be a kernel argument"
+		}
+		renderIPXEError(w, http.StatusInternalServerError, message)
+		return errtrace.Errorf("%w: %w", errRenderIPXE, err)
+	}
+	args := append([]string{"initrd=initrd"}, kernelArgs...)
+	if p.Ignition.Configured() {
+		ignitionURL := systemURL(base + "/ignition")
+		if p.Ignition.OneTime {
+			token, err := s.mintProvisioningToken(r.Context(), machineID, p.ID)
+			if err != nil {
+				renderIPXEError(w, http.StatusInternalServerError, "cannot issue a provisioning token")
+				return errtrace.Errorf("%w: %w", errRenderIPXE, err)
+			}
+			if token != "" {
+				ignitionURL += "&" + url.Values{provisioningTokenParam: {token}}.Encode()
+			}
+		}
+		args = append(args, "ignition.config.url="+ignitionURL)
+	}
+	if machineID != "" {
+		// for a unit of the booted system to report back with
+		args = append(args, "hokuchi.booted_url="+baseURL(r)+s.bootedURL(r, machineID))
+	}
+	params := ipxeParams{
+		Kernel: ipxeKernel{
+			URI:  ipxeURL(base + "/flatcar/kernel"),
+			Args: args,
+		},
+		Images: []ipxeImage{
+			{Name: "initrd", URI: ipxeURL(base + "/flatcar/initrd")},
+		},
+	}
+
+	var b bytes.Buffer
+	if err := ipxeTemplate.Execute(&b, params); err != nil {
+		renderIPXEError(w, http.StatusInternalServerError, "")
+		return errtrace.Errorf("%w: %w", errRenderIPXE, err)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := b.WriteTo(w); err != nil {
+		return errtrace.Wrap(err)
+	}
+	return nil
+}
+
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// renderRetryIPXE makes the machine request r again after sleep seconds, with param set to value.
+func renderRetryIPXE(w http.ResponseWriter, r *http.Request, message string, sleep int, param, value string) error {
 	w.Header().Set("Content-Type", "text/plain")
 
 	retryURL := *r.URL
 	query := retryURL.Query()
-	query.Set("attempt", strconv.FormatInt(int64(nextAttempt), 10))
+	query.Set(param, value)
 	retryURL.RawQuery = query.Encode()
 
 	var b bytes.Buffer
 	fmt.Fprintln(&b, "#!ipxe")
-	fmt.Fprintf(&b, "echo Retry after %ds...\n", sleep)
+	fmt.Fprintf(&b, "echo %s\n", message)
 	fmt.Fprintf(&b, "sleep %d\n", sleep)
 	fmt.Fprintf(&b, "chain --replace %s\n", retryURL.String())
 
@@ -96,10 +397,15 @@ func renderIPXEError(w http.ResponseWriter, code int, message string) error {
 	if message == "" {
 		message = http.StatusText(code)
 	}
+	return renderIPXEFailure(w, code, fmt.Sprintf("%d - %s", code, message), profile.RetryExhaustedShell)
+}
+
+// renderIPXEFailure shows message and then runs command, "shell" or "exit".
+func renderIPXEFailure(w http.ResponseWriter, code int, message string, command string) error {
 	var b bytes.Buffer
 	fmt.Fprintln(&b, "#!ipxe")
-	fmt.Fprintf(&b, "echo %d - %s\n", code, message)
-	fmt.Fprintln(&b, "shell")
+	fmt.Fprintf(&b, "echo %s\n", message)
+	fmt.Fprintln(&b, command)
 
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(code)
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tosuke/hokuchi/inventory"
+	"github.com/tosuke/hokuchi/profile"
+	"github.com/tosuke/hokuchi/state"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  profile.RetryPolicy
+		attempt int
+		// the wait is drawn from [min, max] seconds
+		min, max int
+	}{
+		{name: "first attempt", policy: profile.RetryPolicy{BaseSeconds: 10, CapSeconds: 600}, attempt: 0, min: 5, max: 10},
+		{name: "doubles", policy: profile.RetryPolicy{BaseSeconds: 10, CapSeconds: 600}, attempt: 3, min: 40, max: 80},
+		{name: "capped", policy: profile.RetryPolicy{BaseSeconds: 10, CapSeconds: 600}, attempt: 10, min: 300, max: 600},
+		{name: "no overflow", policy: profile.RetryPolicy{BaseSeconds: 10, CapSeconds: 600}, attempt: 100, min: 300, max: 600},
+		{name: "base at cap", policy: profile.RetryPolicy{BaseSeconds: 1, CapSeconds: 1}, attempt: 5, min: 1, max: 1},
+		{name: "zero", policy: profile.RetryPolicy{}, attempt: 2, min: 0, max: 0},
+		{name: "zero base", policy: profile.RetryPolicy{CapSeconds: 600}, attempt: 1 << 40, min: 0, max: 0},
+		{name: "out of bounds", policy: profile.RetryPolicy{BaseSeconds: math.MaxInt, CapSeconds: math.MaxInt}, attempt: 62, min: profile.MaxRetrySeconds / 2, max: profile.MaxRetrySeconds},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if got := backoff(tt.policy, tt.attempt); got < tt.min || got > tt.max {
+					t.Fatalf("backoff() = %d, want within [%d, %d]", got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderFlatcarIPXEMintFailure(t *testing.T) {
+	db, err := state.Open(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// minting fails on a closed database
+	db.Close()
+	s := &Server{Inventory: inventory.New(db)}
+	p := profile.Profile{
+		ID:       "web",
+		Arch:     "amd64",
+		Boot:     profile.Boot{Flatcar: &profile.Flatcar{Channel: "stable", Version: "current"}},
+		Ignition: profile.Ignition{Inline: `{}`, OneTime: true},
+	}
+
+	w := httptest.NewRecorder()
+	err = s.renderFlatcarIPXE(w, httptest.NewRequest("GET", "/ipxe", nil), p, "52-54-00-00-00-01")
+	if !errors.Is(err, errRenderIPXE) {
+		t.Fatalf("renderFlatcarIPXE() error = %v, want %v", err, errRenderIPXE)
+	}
+	if w.Code != http.StatusInternalServerError || !strings.HasPrefix(w.Body.String(), "#!ipxe\n") {
+		t.Errorf("served %d %q, want an error script", w.Code, w.Body.String())
+	}
+}
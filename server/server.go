@@ -2,9 +2,11 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"log/slog"
 	"net/http"
+	"sync"
 	"time"
 
 	"braces.dev/errtrace"
@@ -12,7 +14,13 @@ import (
 	"github.com/go-chi/chi/v5/middleware"
 	slogchi "github.com/samber/slog-chi"
 	"github.com/tosuke/hokuchi/flatcar"
+	"github.com/tosuke/hokuchi/inventory"
+	"github.com/tosuke/hokuchi/metrics"
+	"github.com/tosuke/hokuchi/profile"
+	"github.com/tosuke/hokuchi/secret"
 	"github.com/tosuke/hokuchi/storage"
+	"github.com/tosuke/hokuchi/syncmap"
+	"github.com/tosuke/hokuchi/tracing"
 )
 
 type Server struct {
@@ -20,59 +28,194 @@ type Server struct {
 	AssetsPath string
 	Flatcar    *flatcar.Fetcher
 	Storage    storage.Storage
+	Profiles   *profile.Registry
+	Inventory  *inventory.Inventory
+	Metrics    *metrics.Metrics
+	// Auth guards the admin API. It is left open when nil.
+	Auth *Authenticator
+	// Secrets resolves ${secret:NAME} references in profiles. References fail to resolve when nil.
+	Secrets *secret.Store
+	// Signer protects artifact and ignition URLs. They are served to anyone when nil.
+	Signer *URLSigner
+	// BootAllowedCIDRs and AdminAllowedCIDRs restrict the clients of each listener. Empty allows any.
+	BootAllowedCIDRs  []string
+	AdminAllowedCIDRs []string
+	// FallbackProfiles maps normalized architectures to the profile of machines no group matches.
+	FallbackProfiles map[string]string
+	// Discovery holds machines seen for the first time until an operator approves them,
+	// asking them to check back every DiscoveryInterval.
+	Discovery         bool
+	DiscoveryInterval time.Duration
+	// SeparateMetrics stops serving /metrics on the admin listener, for when StartMetrics is used.
+	SeparateMetrics bool
 
-	serv *http.Server
+	// fragments caches the ignition fragments fetched from their source, by URL.
+	fragments syncmap.M[string, cachedFragment]
+
+	mu          sync.Mutex
+	serv        *http.Server
+	adminServ   *http.Server
+	metricsServ *http.Server
 }
 
-func (s *Server) HTTPHandler() http.Handler {
-	logger := s.Logger
-	if logger == nil {
-		logger = slog.Default()
+// Listener configures where one of the server's planes is served.
+type Listener struct {
+	Addr string
+	// TLS serves HTTPS when set. It must provide certificates through GetCertificate or Certificates.
+	TLS *tls.Config
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
 	}
+	return s.Logger
+}
 
+func (s *Server) HTTPHandler() http.Handler {
 	r := chi.NewRouter()
-	r.Use(slogchi.New(logger.WithGroup("http")))
+	r.Use(tracing.Middleware)
+	r.Use(slogchi.New(s.logger().WithGroup("http")))
+	r.Use(s.Metrics.Middleware)
 	r.Use(middleware.Recoverer)
 
-	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		time.Sleep(5 * time.Second)
-		w.Write([]byte("hello"))
+	r.Get("/healthz", s.HandleHealthz)
+	r.Get("/readyz", s.HandleReadyz)
+
+	// boot scripts are refused with a script that iPXE shows, everything else with a plain status
+	r.Group(func(r chi.Router) {
+		r.Use(allowlist(s.BootAllowedCIDRs, denyIPXE))
+		r.Get("/boot.ipxe", s.HandleBootstrapIPXE)
+		r.Get("/ipxe", s.HandleIPXE)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(allowlist(s.BootAllowedCIDRs, denyForbidden))
+		r.HandleFunc("/boot_{arch}.efi", s.HandleBootbin)
+		r.Group(func(r chi.Router) {
+			r.Use(s.requireSignedURL)
+			r.Use(s.profileAllowlist(denyForbidden))
+			r.Get("/profile/{pid}/flatcar/kernel", s.HandleFlatcarKernel)
+			r.Get("/profile/{pid}/flatcar/initrd", s.HandleFlatcarInitrd)
+			r.Get("/profile/{pid}/ignition", s.HandleIgnition)
+		})
+		r.With(s.requireSignedURL).Post("/machine/{mid}/booted", s.HandleBooted)
 	})
-	r.HandleFunc("/boot_{arch}.efi", s.HandleBootbin)
-	r.Get("/boot.ipxe", s.HandleBootstrapIPXE)
-	r.Get("/ipxe", s.HandleIPXE)
-	r.Get("/profile/{pid}/flatcar/kernel", s.HandleFlatcarKernel)
-	r.Get("/profile/{pid}/flatcar/initrd", s.HandleFlatcarInitrd)
-	// r.Get("/profile/{pid}/ignition")
 
 	return r
 }
 
-func (s *Server) Start(addr string) error {
-	if s.serv != nil {
+func (s *Server) AdminHTTPHandler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(tracing.Middleware)
+	r.Use(slogchi.New(s.logger().WithGroup("http")))
+	r.Use(s.Metrics.Middleware)
+	r.Use(middleware.Recoverer)
+
+	r.Get("/healthz", s.HandleHealthz)
+	r.Get("/readyz", s.HandleReadyz)
+	r.With(allowlist(s.AdminAllowedCIDRs, denyAPI)).Route("/api/v1", s.apiRoutes)
+	if s.Metrics != nil && !s.SeparateMetrics {
+		r.With(allowlist(s.AdminAllowedCIDRs, denyAPI), s.requireRole).Handle("/metrics", s.Metrics.Handler())
+	}
+
+	return r
+}
+
+func (s *Server) MetricsHTTPHandler() http.Handler {
+	r := chi.NewRouter()
+	r.Use(middleware.Recoverer)
+
+	r.Get("/healthz", s.HandleHealthz)
+	if s.Metrics != nil {
+		r.Handle("/metrics", s.Metrics.Handler())
+	}
+
+	return r
+}
+
+// Start serves the boot plane that iPXE clients talk to.
+func (s *Server) Start(l Listener) error {
+	return s.listenAndServe(&s.serv, l, s.HTTPHandler())
+}
+
+// StartAdmin serves the admin API.
+func (s *Server) StartAdmin(l Listener) error {
+	return s.listenAndServe(&s.adminServ, l, s.AdminHTTPHandler())
+}
+
+// StartMetrics serves Prometheus metrics on a listener of their own.
+func (s *Server) StartMetrics(l Listener) error {
+	return s.listenAndServe(&s.metricsServ, l, s.MetricsHTTPHandler())
+}
+
+func (s *Server) listenAndServe(serv **http.Server, l Listener, handler http.Handler) error {
+	s.mu.Lock()
+	if *serv != nil {
+		s.mu.Unlock()
 		return errtrace.New("server already started")
 	}
-	s.serv = &http.Server{
-		Addr:    addr,
-		Handler: s.HTTPHandler(),
+	hs := &http.Server{
+		Addr:      l.Addr,
+		Handler:   handler,
+		TLSConfig: l.TLS,
+	}
+	*serv = hs
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		*serv = nil
+		s.mu.Unlock()
+	}()
+	var err error
+	if l.TLS != nil {
+		err = hs.ListenAndServeTLS("", "")
+	} else {
+		err = hs.ListenAndServe()
 	}
-	defer func() { s.serv = nil }()
-	if err := s.serv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+	if !errors.Is(err, http.ErrServerClosed) {
 		return errtrace.Wrap(err)
 	}
 	return nil
 }
 
+func (s *Server) servers() []*http.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var servs []*http.Server
+	for _, hs := range []*http.Server{s.serv, s.adminServ, s.metricsServ} {
+		if hs != nil {
+			servs = append(servs, hs)
+		}
+	}
+	return servs
+}
+
 func (s *Server) Close() error {
-	if s.serv == nil {
+	servs := s.servers()
+	if len(servs) == 0 {
 		return errtrace.New("server not started")
 	}
-	return errtrace.Wrap(s.serv.Close())
+	var errs []error
+	for _, hs := range servs {
+		if err := hs.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errtrace.Wrap(errors.Join(errs...))
 }
 
 func (s *Server) Shutdown(ctx context.Context) error {
-	if s.serv == nil {
+	servs := s.servers()
+	if len(servs) == 0 {
 		return errtrace.New("server not started")
 	}
-	return errtrace.Wrap(s.serv.Shutdown(ctx))
+	var errs []error
+	for _, hs := range servs {
+		if err := hs.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errtrace.Wrap(errors.Join(errs...))
 }
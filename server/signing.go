@@ -0,0 +1,140 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"braces.dev/errtrace"
+)
+
+var (
+	errUnsignedURL = errtrace.New("url is not signed")
+	errExpiredURL  = errtrace.New("url has expired")
+	errBadURLSig   = errtrace.New("url signature mismatch")
+)
+
+const (
+	expiresParam   = "exp"
+	signatureParam = "sig"
+	boundParam     = "ip"
+)
+
+// URLSigner issues short-lived URLs for the artifacts and ignition config of one machine.
+// A signature covers the path, the machine ID, the expiry and, optionally, the client address,
+// so a URL leaked from one machine's boot script is useless for another.
+type URLSigner struct {
+	Key []byte
+	TTL time.Duration
+	// BootedTTL is how long the URL the booted system reports back with stays valid, TTL when zero.
+	// It is used at the end of an install, which may take longer than TTL.
+	BootedTTL time.Duration
+	// BindIP also binds the URLs fetched by iPXE itself to the address the boot script was requested from.
+	// The URLs fetched by the booted kernel are never bound, as it may use another address.
+	BindIP bool
+}
+
+// Sign returns the query that authorizes r's client to fetch path for machineID.
+// bindIP asks to bind the URL to r's client address, if the signer binds URLs at all.
+func (us *URLSigner) Sign(r *http.Request, path, machineID string, bindIP bool) url.Values {
+	return us.sign(r, path, machineID, bindIP, us.TTL)
+}
+
+// SignBooted returns the query that authorizes the booted system to report back at path.
+func (us *URLSigner) SignBooted(r *http.Request, path, machineID string) url.Values {
+	ttl := us.BootedTTL
+	if ttl <= 0 {
+		ttl = us.TTL
+	}
+	return us.sign(r, path, machineID, false, ttl)
+}
+
+func (us *URLSigner) sign(r *http.Request, path, machineID string, bindIP bool, ttl time.Duration) url.Values {
+	exp := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	bound := bindIP && us.BindIP
+	q := url.Values{}
+	if machineID != "" {
+		q.Set(machineIDParam, machineID)
+	}
+	if bound {
+		q.Set(boundParam, "1")
+	}
+	q.Set(expiresParam, exp)
+	q.Set(signatureParam, us.signature(r, path, machineID, exp, bound))
+	return q
+}
+
+// Verify checks the signature and expiry carried by r's query.
+func (us *URLSigner) Verify(r *http.Request) error {
+	q := r.URL.Query()
+	sig, exp := q.Get(signatureParam), q.Get(expiresParam)
+	if sig == "" || exp == "" {
+		return errtrace.Wrap(errUnsignedURL)
+	}
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return errtrace.Wrap(errUnsignedURL)
+	}
+	// the signature covers whether the URL is bound, so the flag cannot be dropped
+	want := us.signature(r, r.URL.EscapedPath(), q.Get(machineIDParam), exp, q.Get(boundParam) == "1")
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return errtrace.Wrap(errBadURLSig)
+	}
+	if time.Now().Unix() > expUnix {
+		return errtrace.Wrap(errExpiredURL)
+	}
+	return nil
+}
+
+func (us *URLSigner) signature(r *http.Request, path, machineID, exp string, bound bool) string {
+	mac := hmac.New(sha256.New, us.Key)
+	mac.Write([]byte(path + "\n" + machineID + "\n" + exp + "\n"))
+	if bound {
+		mac.Write([]byte("ip\n" + sourceIP(r)))
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// requireSignedURL rejects requests whose URL was not issued by s.Signer, when one is configured.
+func (s *Server) requireSignedURL(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Signer != nil {
+			if err := s.Signer.Verify(r); err != nil {
+				slog.WarnContext(r.Context(), "rejected unsigned request", slog.String("path", r.URL.Path), slog.String("reason", err.Error()))
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// signedURL returns path with the query authorizing the machine to fetch it.
+// bindIP is set for URLs fetched by iPXE from the address r came from.
+func (s *Server) signedURL(r *http.Request, path, machineID string, bindIP bool) string {
+	var q url.Values
+	if s.Signer != nil {
+		q = s.Signer.Sign(r, path, machineID, bindIP)
+	} else if machineID != "" {
+		q = url.Values{machineIDParam: {machineID}}
+	}
+	if len(q) == 0 {
+		return path
+	}
+	return path + "?" + q.Encode()
+}
+
+// bootedURL returns the path, with its query, at which the booted machine reports back.
+func (s *Server) bootedURL(r *http.Request, machineID string) string {
+	path := "/machine/" + url.PathEscape(machineID) + "/booted"
+	q := url.Values{machineIDParam: {machineID}}
+	if s.Signer != nil {
+		q = s.Signer.SignBooted(r, path, machineID)
+	}
+	return path + "?" + q.Encode()
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestURLSigner(t *testing.T) {
+	const path = "/profile/web/flatcar/kernel"
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	tests := []struct {
+		name   string
+		signer URLSigner
+		bindIP bool
+		// tamper changes the signed request before it is verified
+		tamper  func(target string) string
+		from    string
+		wantErr error
+	}{
+		{name: "valid", signer: URLSigner{Key: key, TTL: time.Minute}},
+		{
+			name:    "other path",
+			signer:  URLSigner{Key: key, TTL: time.Minute},
+			tamper:  func(target string) string { return "/profile/other/flatcar/kernel?" + query(target) },
+			wantErr: errBadURLSig,
+		},
+		{
+			name:   "other machine",
+			signer: URLSigner{Key: key, TTL: time.Minute},
+			tamper: func(target string) string {
+				return withParam(target, machineIDParam, "52-54-00-00-00-02")
+			},
+			wantErr: errBadURLSig,
+		},
+		{
+			name:   "extended expiry",
+			signer: URLSigner{Key: key, TTL: time.Minute},
+			tamper: func(target string) string {
+				return withParam(target, expiresParam, strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+			},
+			wantErr: errBadURLSig,
+		},
+		{
+			name:    "other key",
+			signer:  URLSigner{Key: key, TTL: time.Minute},
+			tamper:  func(target string) string { return resign(target, []byte("fedcba9876543210fedcba9876543210")) },
+			wantErr: errBadURLSig,
+		},
+		{
+			name:    "expired",
+			signer:  URLSigner{Key: key, TTL: -time.Minute},
+			wantErr: errExpiredURL,
+		},
+		{
+			name:    "unsigned",
+			signer:  URLSigner{Key: key, TTL: time.Minute},
+			tamper:  func(string) string { return path },
+			wantErr: errUnsignedURL,
+		},
+		{name: "bound, same address", signer: URLSigner{Key: key, TTL: time.Minute, BindIP: true}, bindIP: true},
+		{
+			name:    "bound, other address",
+			signer:  URLSigner{Key: key, TTL: time.Minute, BindIP: true},
+			bindIP:  true,
+			from:    "192.0.2.2:1234",
+			wantErr: errBadURLSig,
+		},
+		{
+			name:    "bound, flag dropped",
+			signer:  URLSigner{Key: key, TTL: time.Minute, BindIP: true},
+			bindIP:  true,
+			tamper:  func(target string) string { return withParam(target, boundParam, "") },
+			from:    "192.0.2.2:1234",
+			wantErr: errBadURLSig,
+		},
+		{
+			name:   "unbound URL of a binding signer",
+			signer: URLSigner{Key: key, TTL: time.Minute, BindIP: true},
+			from:   "192.0.2.2:1234",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issue := httptest.NewRequest("GET", "/ipxe", nil)
+			issue.RemoteAddr = "192.0.2.1:1234"
+			target := path + "?" + tt.signer.Sign(issue, path, "52-54-00-00-00-01", tt.bindIP).Encode()
+			if tt.tamper != nil {
+				target = tt.tamper(target)
+			}
+
+			r := httptest.NewRequest("GET", target, nil)
+			r.RemoteAddr = issue.RemoteAddr
+			if tt.from != "" {
+				r.RemoteAddr = tt.from
+			}
+			err := tt.signer.Verify(r)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestURLSignerBooted(t *testing.T) {
+	const path = "/machine/52-54-00-00-00-01/booted"
+	key := []byte("0123456789abcdef0123456789abcdef")
+	tests := []struct {
+		name   string
+		signer URLSigner
+		want   time.Duration
+	}{
+		{name: "own ttl", signer: URLSigner{Key: key, TTL: time.Hour, BootedTTL: 24 * time.Hour, BindIP: true}, want: 24 * time.Hour},
+		{name: "default", signer: URLSigner{Key: key, TTL: time.Hour}, want: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issue := httptest.NewRequest("GET", "/ipxe", nil)
+			q := tt.signer.SignBooted(issue, path, "52-54-00-00-00-01")
+			exp, err := strconv.ParseInt(q.Get(expiresParam), 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := time.Until(time.Unix(exp, 0)); got < tt.want-time.Minute || got > tt.want {
+				t.Errorf("valid for %s, want %s", got, tt.want)
+			}
+			if q.Has(boundParam) {
+				t.Error("booted URL is bound to the client address")
+			}
+
+			// the booted system reports back from wherever its network puts it
+			r := httptest.NewRequest("POST", path+"?"+q.Encode(), nil)
+			r.RemoteAddr = "198.51.100.1:1234"
+			if err := tt.signer.Verify(r); err != nil {
+				t.Fatalf("Verify() error = %v", err)
+			}
+		})
+	}
+}
+
+func query(target string) string {
+	u, _ := url.Parse(target)
+	return u.RawQuery
+}
+
+func withParam(target, name, value string) string {
+	u, _ := url.Parse(target)
+	q := u.Query()
+	if value == "" {
+		q.Del(name)
+	} else {
+		q.Set(name, value)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// resign replaces the signature of target with one made with key.
+func resign(target string, key []byte) string {
+	u, _ := url.Parse(target)
+	q := u.Query()
+	other := URLSigner{Key: key}
+	sig := other.signature(httptest.NewRequest("GET", target, nil), u.EscapedPath(), q.Get(machineIDParam), q.Get(expiresParam), false)
+	return withParam(target, signatureParam, sig)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi/slogerr"
+)
+
+// CertReloader serves a certificate loaded from PEM files and picks up replacements of the files.
+// A replacement that cannot be loaded is logged and the previous certificate stays in use.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	cr := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := cr.reload(); err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	return cr, nil
+}
+
+// TLSConfig returns a server configuration that always presents the current certificate.
+func (cr *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+}
+
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// Run checks the files for changes every interval until ctx is done.
+func (cr *CertReloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		reloaded, err := cr.reload()
+		if err != nil {
+			slog.ErrorContext(ctx, "Error reloading certificate", slog.String("cert", cr.certFile), slogerr.Err(err))
+			continue
+		}
+		if reloaded {
+			slog.InfoContext(ctx, "reloaded certificate", slog.String("cert", cr.certFile))
+		}
+	}
+}
+
+// reload loads the files if either has been modified since the last load.
+func (cr *CertReloader) reload() (bool, error) {
+	modTime, err := latestModTime(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, errtrace.Wrap(err)
+	}
+	cr.mu.RLock()
+	unchanged := cr.cert != nil && modTime.Equal(cr.modTime)
+	cr.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, errtrace.Wrap(err)
+	}
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.mu.Unlock()
+	return true, nil
+}
+
+func latestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, errtrace.Wrap(err)
+		}
+		if mt := info.ModTime(); mt.After(latest) {
+			latest = mt
+		}
+	}
+	return latest, nil
+}
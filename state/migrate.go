@@ -0,0 +1,75 @@
+package state
+
+import (
+	"encoding/binary"
+	"log/slog"
+
+	"braces.dev/errtrace"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	BucketMeta     = "meta"
+	BucketProfiles = "profiles"
+	BucketGroups   = "groups"
+	BucketMachines = "machines"
+	BucketEvents   = "events"
+	// BucketProvisioning holds one-time ignition tokens by machine ID
+	BucketProvisioning = "provisioning"
+)
+
+var schemaVersionKey = []byte("schemaVersion")
+
+type migration struct {
+	name string
+	up   func(tx *bbolt.Tx) error
+}
+
+// migrations are applied in order; schema version N means the first N have been applied.
+// Append new migrations to the end and never edit released ones.
+var migrations = []migration{
+	{name: "create profile buckets", up: createBuckets(BucketProfiles, BucketGroups)},
+	{name: "create machine inventory bucket", up: createBuckets(BucketMachines)},
+	{name: "create boot event bucket", up: createBuckets(BucketEvents)},
+	{name: "create provisioning token bucket", up: createBuckets(BucketProvisioning)},
+}
+
+func createBuckets(names ...string) func(tx *bbolt.Tx) error {
+	return func(tx *bbolt.Tx) error {
+		for _, name := range names {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return errtrace.Wrap(err)
+			}
+		}
+		return nil
+	}
+}
+
+func (db *DB) migrate() error {
+	return errtrace.Wrap(db.bolt.Update(func(tx *bbolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(BucketMeta))
+		if err != nil {
+			return errtrace.Wrap(err)
+		}
+
+		var version uint64
+		if v := meta.Get(schemaVersionKey); v != nil {
+			version = binary.BigEndian.Uint64(v)
+		}
+		if version > uint64(len(migrations)) {
+			return errtrace.Errorf("state schema version %d is newer than supported version %d", version, len(migrations))
+		}
+
+		for i := version; i < uint64(len(migrations)); i++ {
+			m := migrations[i]
+			slog.Info("applying state migration", slog.Uint64("version", i+1), slog.String("name", m.name))
+			if err := m.up(tx); err != nil {
+				return errtrace.Wrap(err)
+			}
+		}
+
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(len(migrations)))
+		return errtrace.Wrap(meta.Put(schemaVersionKey, v))
+	}))
+}
@@ -0,0 +1,132 @@
+package state
+
+import (
+	"encoding/json"
+	"time"
+
+	"braces.dev/errtrace"
+	"go.etcd.io/bbolt"
+)
+
+var (
+	ErrNotFound = errtrace.New("state: not found")
+	ErrNoBucket = errtrace.New("state: bucket does not exist")
+)
+
+// DB is an embedded key-value store for structured data that must survive restarts.
+// Values are stored as JSON in buckets created by migrations.
+type DB struct {
+	bolt *bbolt.DB
+}
+
+type Tx struct {
+	tx *bbolt.Tx
+}
+
+func Open(path string) (*DB, error) {
+	b, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	db := &DB{bolt: b}
+	if err := db.migrate(); err != nil {
+		b.Close()
+		return nil, errtrace.Wrap(err)
+	}
+	return db, nil
+}
+
+func (db *DB) Close() error {
+	return errtrace.Wrap(db.bolt.Close())
+}
+
+func (db *DB) View(fn func(tx *Tx) error) error {
+	return errtrace.Wrap(db.bolt.View(func(tx *bbolt.Tx) error {
+		return fn(&Tx{tx: tx})
+	}))
+}
+
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	return errtrace.Wrap(db.bolt.Update(func(tx *bbolt.Tx) error {
+		return fn(&Tx{tx: tx})
+	}))
+}
+
+func (tx *Tx) bucket(name string) (*bbolt.Bucket, error) {
+	b := tx.tx.Bucket([]byte(name))
+	if b == nil {
+		return nil, errtrace.Errorf("%w: %s", ErrNoBucket, name)
+	}
+	return b, nil
+}
+
+func (tx *Tx) Get(bucket, key string, v any) error {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	data := b.Get([]byte(key))
+	if data == nil {
+		return errtrace.Wrap(ErrNotFound)
+	}
+	return errtrace.Wrap(json.Unmarshal(data, v))
+}
+
+func (tx *Tx) Put(bucket, key string, v any) error {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	return errtrace.Wrap(b.Put([]byte(key), data))
+}
+
+func (tx *Tx) Delete(bucket, key string) error {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	return errtrace.Wrap(b.Delete([]byte(key)))
+}
+
+// NextSequence returns a monotonically increasing number for the bucket, suitable for ordered keys.
+func (tx *Tx) NextSequence(bucket string) (uint64, error) {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return 0, errtrace.Wrap(err)
+	}
+	seq, err := b.NextSequence()
+	return seq, errtrace.Wrap(err)
+}
+
+// ForEach decodes every value in bucket in key order.
+func ForEach[T any](tx *Tx, bucket string, fn func(key string, v T) error) error {
+	return ForEachPrefix(tx, bucket, "", fn)
+}
+
+// ForEachPrefix decodes the values whose keys start with prefix in key order.
+func ForEachPrefix[T any](tx *Tx, bucket, prefix string, fn func(key string, v T) error) error {
+	b, err := tx.bucket(bucket)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	c := b.Cursor()
+	p := []byte(prefix)
+	for k, data := c.Seek(p); k != nil && hasPrefix(k, p); k, data = c.Next() {
+		var v T
+		if err := json.Unmarshal(data, &v); err != nil {
+			return errtrace.Wrap(err)
+		}
+		if err := fn(string(k), v); err != nil {
+			return errtrace.Wrap(err)
+		}
+	}
+	return nil
+}
+
+func hasPrefix(b, prefix []byte) bool {
+	return len(b) >= len(prefix) && string(b[:len(prefix)]) == string(prefix)
+}
@@ -2,62 +2,254 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"hash"
 	"io"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"braces.dev/errtrace"
 	"github.com/tosuke/hokuchi/syncmap"
+	"github.com/tosuke/hokuchi/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/tosuke/hokuchi/storage")
+
+const (
+	tempPrefix = "hokuchi-"
+	// temp files younger than this may belong to another running instance sharing tempDir
+	staleTempAge = 10 * time.Minute
 )
 
 type fsStorage struct {
 	dataDir string
 	tempDir string
+	// tempDir and dataDir are on different filesystems, so commit cannot rename atomically
+	crossDevice bool
+
+	quota   int64
+	pinned  func() []string
+	used    atomic.Int64
+	evictMu sync.Mutex
 
 	running syncmap.M[string, *fsTx]
+	// verified holds the files whose digest was found to match their metadata
+	verified syncmap.M[string, os.FileInfo]
 }
 type fsTx struct {
 	s        *fsStorage
 	key      string
 	tempFile *os.File
+	hash     hash.Hash
+	sig      []byte
+
+	// progress is shared with readers streaming the blob while it is being written
+	mu      sync.Mutex
+	cond    *sync.Cond
+	written int64
+	done    bool
+	err     error
+	// reserved is the part of the quota held for the blob, never less than written
+	reserved int64
+}
+
+type FSOption struct {
+	DataDir string
+	TempDir string
+	// Quota limits the total size of stored blobs in bytes. Zero means unlimited.
+	Quota int64
+	// Pinned lists the keys of blobs that are still in use and must not be evicted.
+	// It is called on every eviction, so it must be cheap and must not wait on the network.
+	Pinned func() []string
 }
 
-func NewFSStorage(dataDir string, tempDir string) Storage {
-	return &fsStorage{
+func NewFSStorage(option FSOption) (Storage, error) {
+	dataDir, tempDir := option.DataDir, option.TempDir
+	s := &fsStorage{
 		dataDir: dataDir,
 		tempDir: tempDir,
+		quota:   option.Quota,
+		pinned:  option.Pinned,
+	}
+
+	for _, dir := range []string{dataDir, tempDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, errtrace.Wrap(err)
+		}
+	}
+	if err := s.removeStaleTemps(); err != nil {
+		return nil, errtrace.Wrap(err)
 	}
+	crossDevice, err := s.checkCrossDevice()
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	if crossDevice {
+		slog.Warn("temp and data directories are on different filesystems; commits will copy instead of rename",
+			slog.String("tempDir", tempDir), slog.String("dataDir", dataDir))
+	}
+	s.crossDevice = crossDevice
+
+	blobs, err := s.listBlobs()
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	for _, b := range blobs {
+		s.used.Add(b.size)
+	}
+
+	return s, nil
 }
 
 var _ Storage = (*fsStorage)(nil)
 
-func (s *fsStorage) Get(ctx context.Context, key string) (int64, io.ReadCloser, error) {
-	path := s.pathForKey(key)
+func (s *fsStorage) Get(ctx context.Context, key string) (_ int64, _ io.ReadCloser, err error) {
+	ctx, span := tracer.Start(ctx, "storage.Get", trace.WithAttributes(attribute.String("storage.key", key)))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	path, err := s.pathForKey(key)
+	if err != nil {
+		return 0, nil, errtrace.Wrap(err)
+	}
 	file, err := os.Open(path)
 	if err != nil {
-		if errors.Is(err, &fs.PathError{}) || errors.Is(err, fs.ErrNotExist) {
-			return 0, nil, errtrace.Wrap(ErrNotfound)
+		if !errors.Is(err, &fs.PathError{}) && !errors.Is(err, fs.ErrNotExist) {
+			return 0, nil, errtrace.Wrap(err)
+		}
+		if tx, ok := s.running.Load(key); ok {
+			if r, err := tx.newReader(ctx); err == nil {
+				span.SetAttributes(attribute.Bool("storage.in_flight", true))
+				return -1, r, nil
+			}
+		}
+		// the transaction may have been committed in the meantime
+		file, err = os.Open(path)
+		if err != nil {
+			if errors.Is(err, &fs.PathError{}) || errors.Is(err, fs.ErrNotExist) {
+				return 0, nil, errtrace.Wrap(ErrNotfound)
+			}
+			return 0, nil, errtrace.Wrap(err)
 		}
-		return 0, nil, errtrace.Wrap(err)
 	}
 
 	stat, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return 0, nil, errtrace.Wrap(err)
 	}
 	size := stat.Size()
 
-	return size, file, nil
+	md, err := s.readMeta(key)
+	if err != nil {
+		if errors.Is(err, ErrNotfound) {
+			// stored before metadata was recorded
+			return size, file, nil
+		}
+		file.Close()
+		return 0, nil, errtrace.Wrap(err)
+	}
+	if v, ok := s.verified.Load(key); ok && os.SameFile(v, stat) && v.Size() == size {
+		return size, file, nil
+	}
+	if size != md.Size {
+		file.Close()
+		return 0, nil, errtrace.Wrap(s.corrupted(md, "size", strconv.FormatInt(md.Size, 10), strconv.FormatInt(size, 10)))
+	}
+	// the digest is checked as the blob is read, so that serving a blob does not wait for a full pass over it
+	return size, newVerifyingReader(s, file, stat, md), nil
+}
+
+func (s *fsStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.pathForKey(key)
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	md, err := s.readMeta(key)
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errtrace.Wrap(ErrNotfound)
+		}
+		return nil, errtrace.Wrap(err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, errtrace.Wrap(err)
+	}
+	return newVerifyingReader(s, file, stat, md), nil
+}
+
+func (s *fsStorage) Stat(ctx context.Context, key string) (Metadata, error) {
+	path, err := s.pathForKey(key)
+	if err != nil {
+		return Metadata{}, errtrace.Wrap(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return Metadata{}, errtrace.Wrap(ErrNotfound)
+		}
+		return Metadata{}, errtrace.Wrap(err)
+	}
+	md, err := s.readMeta(key)
+	if err != nil {
+		return Metadata{}, errtrace.Wrap(err)
+	}
+	return md, nil
+}
+
+func (s *fsStorage) List(ctx context.Context) ([]Metadata, error) {
+	mds, err := s.listMeta()
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	return mds, nil
+}
+
+func (s *fsStorage) Quarantine(ctx context.Context, key string) error {
+	return s.quarantine(key)
 }
 
-func (s *fsStorage) Add(ctx context.Context, key string) (TxWriter, error) {
-	if _, err := os.Stat(s.pathForKey(key)); err == nil {
+func (s *fsStorage) Add(ctx context.Context, key string) (_ TxWriter, err error) {
+	ctx, span := tracer.Start(ctx, "storage.Add", trace.WithAttributes(attribute.String("storage.key", key)))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
+	path, err := s.pathForKey(key)
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	if _, err := os.Stat(path); err == nil {
 		return nil, errtrace.Wrap(ErrExists)
 	}
+	if s.quota > 0 && s.used.Load() >= s.quota {
+		if err := s.evict(ctx, 1); err != nil {
+			return nil, errtrace.Wrap(err)
+		}
+	}
 
-	temp, err := os.CreateTemp(s.tempDir, "hokuchi-*")
+	temp, err := os.CreateTemp(s.tempDir, tempPrefix+"*")
 	if err != nil {
 		return nil, errtrace.Wrap(err)
 	}
@@ -65,7 +257,9 @@ func (s *fsStorage) Add(ctx context.Context, key string) (TxWriter, error) {
 		s:        s,
 		key:      key,
 		tempFile: temp,
+		hash:     sha256.New(),
 	}
+	tx.cond = sync.NewCond(&tx.mu)
 
 	if _, loaded := s.running.LoadOrStore(key, tx); loaded {
 		temp.Close()
@@ -76,6 +270,22 @@ func (s *fsStorage) Add(ctx context.Context, key string) (TxWriter, error) {
 	return tx, nil
 }
 
+func (s *fsStorage) Check(ctx context.Context) error {
+	for dir, prefix := range map[string]string{s.tempDir: tempPrefix, s.dataDir: "." + tempPrefix} {
+		f, err := os.CreateTemp(dir, prefix+"check-*")
+		if err != nil {
+			return errtrace.Wrap(err)
+		}
+		_, werr := f.Write([]byte{0})
+		cerr := f.Close()
+		os.Remove(f.Name())
+		if err := errors.Join(werr, cerr); err != nil {
+			return errtrace.Wrap(err)
+		}
+	}
+	return nil
+}
+
 func (s *fsStorage) Close() error {
 	var txs []*fsTx
 	s.running.Range(func(_ string, tx *fsTx) bool {
@@ -96,16 +306,31 @@ func (s *fsStorage) Close() error {
 	return nil
 }
 
-func (s *fsStorage) pathForKey(key string) string {
-	return filepath.Join(s.dataDir, key)
+func (s *fsStorage) pathForKey(key string) (string, error) {
+	if !ValidKey(key) {
+		return "", errtrace.Wrap(ErrInvalidKey)
+	}
+	rel := filepath.FromSlash(key)
+	if !filepath.IsLocal(rel) {
+		return "", errtrace.Wrap(ErrInvalidKey)
+	}
+	return filepath.Join(s.dataDir, rel), nil
 }
 
-func (s *fsStorage) close(key string) {
-	s.running.Delete(key)
+// close forgets tx, unless another transaction has been started for its key since.
+func (s *fsStorage) close(tx *fsTx) {
+	s.running.CompareAndDelete(tx.key, tx)
 }
 
 func (s *fsStorage) rollback(tx *fsTx) error {
-	defer s.running.Delete(tx.key)
+	defer s.close(tx)
+	if !tx.finish(ErrAborted) {
+		// committed, or rolled back by a failed commit
+		return nil
+	}
+	tx.mu.Lock()
+	s.used.Add(-tx.reserved)
+	tx.mu.Unlock()
 	tx.tempFile.Close()
 
 	path := tx.tempFile.Name()
@@ -115,29 +340,232 @@ func (s *fsStorage) rollback(tx *fsTx) error {
 	return nil
 }
 
-func (s *fsStorage) commit(tx *fsTx) error {
+func (s *fsStorage) commit(tx *fsTx) (err error) {
+	tmpPath := tx.tempFile.Name()
+	// metaWritten is set while the metadata of a blob that is not in place yet exists
+	metaWritten := false
 	defer func() {
-		tx.s.close(tx.key)
+		if err != nil {
+			// a failed commit leaves nothing behind
+			if tmpPath != "" {
+				os.Remove(tmpPath)
+			}
+			if metaWritten {
+				os.Remove(s.metaPathForKey(tx.key))
+			}
+			if tx.finish(ErrAborted) {
+				tx.mu.Lock()
+				s.used.Add(-tx.reserved)
+				tx.mu.Unlock()
+			}
+		} else if tx.finish(nil) {
+			// give back what was reserved beyond the actual size
+			tx.mu.Lock()
+			s.used.Add(tx.written - tx.reserved)
+			tx.mu.Unlock()
+		}
+		tx.s.close(tx)
 		tx.tempFile.Close()
 	}()
-	tmpPath := tx.tempFile.Name()
-	desiredPath := s.pathForKey(tx.key)
+	desiredPath, err := s.pathForKey(tx.key)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(desiredPath), 0o755); err != nil {
+		return errtrace.Wrap(err)
+	}
 
 	if err := tx.tempFile.Sync(); err != nil {
 		return errtrace.Wrap(err)
 	}
 	tx.tempFile.Close()
 
+	md := Metadata{
+		Key:         tx.key,
+		Size:        tx.written,
+		SHA256:      hex.EncodeToString(tx.hash.Sum(nil)),
+		Signature:   tx.sig,
+		CommittedAt: time.Now(),
+	}
+	if err := s.writeMeta(md); err != nil {
+		return errtrace.Wrap(err)
+	}
+	metaWritten = true
+
+	if s.crossDevice {
+		copied, err := s.copyToDataDir(tmpPath)
+		if err != nil {
+			return errtrace.Wrap(err)
+		}
+		os.Remove(tmpPath)
+		tmpPath = copied
+	}
+
 	if err := os.Rename(tmpPath, desiredPath); err != nil {
 		return errtrace.Wrap(err)
 	}
+	// the blob is in place; a failure from here on must not remove it
+	tmpPath, metaWritten = "", false
+	if err := syncDir(filepath.Dir(desiredPath)); err != nil {
+		return errtrace.Wrap(err)
+	}
+	// the digest was computed from the data as it was written
+	if info, err := os.Stat(desiredPath); err == nil {
+		s.verified.Store(tx.key, info)
+	}
+	return nil
+}
+
+// copyToDataDir copies a temp file next to its destination so that the final rename stays atomic.
+func (s *fsStorage) copyToDataDir(src string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", errtrace.Wrap(err)
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(s.dataDir, "."+tempPrefix+"*")
+	if err != nil {
+		return "", errtrace.Wrap(err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", errtrace.Wrap(err)
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", errtrace.Wrap(err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", errtrace.Wrap(err)
+	}
+	return out.Name(), nil
+}
+
+// removeStaleTemps removes temp files left behind by a crashed process. Files younger than
+// staleTempAge are kept everywhere, as they may belong to another instance sharing the directories.
+func (s *fsStorage) removeStaleTemps() error {
+	var errs []error
+	remove := func(path string, entry fs.DirEntry, prefix string) {
+		if !entry.Type().IsRegular() || !strings.HasPrefix(entry.Name(), prefix) {
+			return
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTempAge {
+			return
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+			return
+		}
+		slog.Info("removed stale temp file", slog.String("path", path))
+	}
+	removeIn := func(dir, prefix string) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		for _, entry := range entries {
+			remove(filepath.Join(dir, entry.Name()), entry, prefix)
+		}
+	}
+	removeIn(s.tempDir, tempPrefix)
+	// copies staged for a cross-device commit
+	removeIn(s.dataDir, "."+tempPrefix)
+	// metadata being written, anywhere below the metadata directory
+	err := filepath.WalkDir(filepath.Join(s.dataDir, metaDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			return nil
+		}
+		remove(path, d, "."+tempPrefix)
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return errtrace.Wrap(errors.Join(errs...))
+	}
+	return nil
+}
+
+func (s *fsStorage) checkCrossDevice() (bool, error) {
+	probe, err := os.CreateTemp(s.tempDir, tempPrefix+"probe-*")
+	if err != nil {
+		return false, errtrace.Wrap(err)
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+
+	target := filepath.Join(s.dataDir, "."+tempPrefix+"probe-"+filepath.Base(probe.Name()))
+	if err := os.Rename(probe.Name(), target); err != nil {
+		if errors.Is(err, syscall.EXDEV) {
+			return true, nil
+		}
+		return false, errtrace.Wrap(err)
+	}
+	if err := os.Remove(target); err != nil {
+		return false, errtrace.Wrap(err)
+	}
+	return false, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return errtrace.Wrap(err)
+	}
 	return nil
 }
 
 var _ TxWriter = (*fsTx)(nil)
 
 func (tx *fsTx) Write(b []byte) (int, error) {
-	return tx.tempFile.Write(b)
+	// without a reservation covering it, the data is accounted as it is written
+	if err := tx.Reserve(tx.written + int64(len(b))); err != nil {
+		return 0, errtrace.Wrap(err)
+	}
+	n, err := tx.tempFile.Write(b)
+	tx.hash.Write(b[:n])
+	if n > 0 {
+		tx.mu.Lock()
+		tx.written += int64(n)
+		tx.mu.Unlock()
+		tx.cond.Broadcast()
+	}
+	return n, err
+}
+
+func (tx *fsTx) SetSignature(sig []byte) {
+	tx.sig = sig
+}
+
+func (tx *fsTx) Reserve(size int64) error {
+	tx.mu.Lock()
+	extra := size - tx.reserved
+	tx.mu.Unlock()
+	if extra <= 0 {
+		return nil
+	}
+	if err := tx.s.reserve(context.Background(), extra); err != nil {
+		return errtrace.Wrap(err)
+	}
+	tx.mu.Lock()
+	tx.reserved += extra
+	tx.mu.Unlock()
+	return nil
 }
 
 func (tx *fsTx) Rollback() error {
@@ -145,5 +573,92 @@ func (tx *fsTx) Rollback() error {
 }
 
 func (tx *fsTx) Commit(ctx context.Context) error {
-	return tx.s.commit(tx)
+	_, span := tracer.Start(ctx, "storage.Commit", trace.WithAttributes(attribute.String("storage.key", tx.key)))
+	defer span.End()
+
+	err := tx.s.commit(tx)
+	tracing.RecordError(span, err)
+	return err
+}
+
+// finish marks the transaction as completed and wakes up readers.
+// It reports false if the transaction had already been completed.
+func (tx *fsTx) finish(err error) bool {
+	tx.mu.Lock()
+	first := !tx.done
+	if first {
+		tx.done = true
+		tx.err = err
+	}
+	tx.mu.Unlock()
+	tx.cond.Broadcast()
+	return first
+}
+
+func (tx *fsTx) newReader(ctx context.Context) (*txReader, error) {
+	file, err := os.Open(tx.tempFile.Name())
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	r := &txReader{
+		ctx:  ctx,
+		tx:   tx,
+		file: file,
+	}
+	r.stop = context.AfterFunc(ctx, func() {
+		// wake up Read so that it can observe the cancellation
+		tx.mu.Lock()
+		defer tx.mu.Unlock()
+		tx.cond.Broadcast()
+	})
+	return r, nil
+}
+
+// txReader streams a blob that is still being written.
+// It blocks until more data arrives, and fails with ErrAborted if the transaction does not commit.
+type txReader struct {
+	ctx  context.Context
+	tx   *fsTx
+	file *os.File
+	off  int64
+	stop func() bool
+}
+
+func (r *txReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	tx := r.tx
+	tx.mu.Lock()
+	for r.off >= tx.written && !tx.done && r.ctx.Err() == nil {
+		tx.cond.Wait()
+	}
+	written, done, txErr := tx.written, tx.done, tx.err
+	tx.mu.Unlock()
+
+	if err := r.ctx.Err(); err != nil {
+		return 0, errtrace.Wrap(err)
+	}
+	if done && txErr != nil {
+		return 0, errtrace.Wrap(txErr)
+	}
+	if r.off >= written {
+		return 0, io.EOF
+	}
+
+	if avail := written - r.off; int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	n, err := r.file.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *txReader) Close() error {
+	r.stop()
+	return errtrace.Wrap(r.file.Close())
 }
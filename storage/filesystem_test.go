@@ -0,0 +1,346 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStorage(t *testing.T, option FSOption) Storage {
+	t.Helper()
+	dir := t.TempDir()
+	if option.DataDir == "" {
+		option.DataDir = filepath.Join(dir, "data")
+	}
+	if option.TempDir == "" {
+		option.TempDir = filepath.Join(dir, "temp")
+	}
+	s, err := NewFSStorage(option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func addBlob(t *testing.T, s Storage, key, data string) {
+	t.Helper()
+	ctx := context.Background()
+	tx, err := s.Add(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemoveStaleTemps(t *testing.T) {
+	dir := t.TempDir()
+	dataDir, tempDir := filepath.Join(dir, "data"), filepath.Join(dir, "temp")
+	old := time.Now().Add(-2 * staleTempAge)
+	files := []struct {
+		path  string
+		old   bool
+		stays bool
+	}{
+		{path: filepath.Join(tempDir, tempPrefix+"1"), old: true},
+		{path: filepath.Join(tempDir, tempPrefix+"2"), stays: true},
+		{path: filepath.Join(tempDir, "other"), old: true, stays: true},
+		{path: filepath.Join(dataDir, "."+tempPrefix+"1"), old: true},
+		{path: filepath.Join(dataDir, "."+tempPrefix+"2"), stays: true},
+		{path: filepath.Join(dataDir, metaDir, "flatcar", "."+tempPrefix+"1"), old: true},
+		{path: filepath.Join(dataDir, metaDir, "flatcar", "."+tempPrefix+"2"), stays: true},
+	}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(f.path, []byte("partial"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if f.old {
+			if err := os.Chtimes(f.path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	newTestStorage(t, FSOption{DataDir: dataDir, TempDir: tempDir})
+	for _, f := range files {
+		_, err := os.Stat(f.path)
+		if f.stays && err != nil {
+			t.Errorf("%s was removed: %v", f.path, err)
+		}
+		if !f.stays && !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s was kept: %v", f.path, err)
+		}
+	}
+}
+
+func TestFailedCommitLeavesNothing(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dataDir, tempDir := filepath.Join(dir, "data"), filepath.Join(dir, "temp")
+	s := newTestStorage(t, FSOption{DataDir: dataDir, TempDir: tempDir})
+
+	tx, err := s.Add(ctx, "flatcar/kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Write([]byte("kernel")); err != nil {
+		t.Fatal(err)
+	}
+	// a non-empty directory in the way makes the final rename fail
+	if err := os.MkdirAll(filepath.Join(dataDir, "flatcar", "kernel", "x"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(ctx); err == nil {
+		t.Fatal("Commit() succeeded")
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("Rollback() after a failed commit: error = %v", err)
+	}
+
+	if entries, err := os.ReadDir(tempDir); err != nil || len(entries) != 0 {
+		t.Errorf("temp dir holds %v, %v", entries, err)
+	}
+	if _, err := os.Stat(s.(*fsStorage).metaPathForKey("flatcar/kernel")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("metadata of the failed commit was kept: %v", err)
+	}
+	if used, _ := s.Usage(ctx); used != 0 {
+		t.Errorf("Usage() = %d, want 0", used)
+	}
+}
+
+func TestRejectedKeys(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t, FSOption{})
+	for _, key := range []string{"", "../outside", "/etc/passwd", ".meta/a", ".quarantine/a", "a/./b"} {
+		if _, err := s.Add(ctx, key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Add(%q) error = %v, want %v", key, err, ErrInvalidKey)
+		}
+		if _, _, err := s.Get(ctx, key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Get(%q) error = %v, want %v", key, err, ErrInvalidKey)
+		}
+		if _, err := s.Open(ctx, key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Open(%q) error = %v, want %v", key, err, ErrInvalidKey)
+		}
+		if err := s.Quarantine(ctx, key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Quarantine(%q) error = %v, want %v", key, err, ErrInvalidKey)
+		}
+	}
+}
+
+func TestReadWhileWriting(t *testing.T) {
+	tests := []struct {
+		name    string
+		finish  func(tx TxWriter) error
+		want    string
+		wantErr error
+	}{
+		{name: "commit", finish: func(tx TxWriter) error { return tx.Commit(context.Background()) }, want: "kernel"},
+		{name: "rollback", finish: func(tx TxWriter) error { return tx.Rollback() }, wantErr: ErrAborted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newTestStorage(t, FSOption{})
+			tx, err := s.Add(ctx, "flatcar/kernel")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Write([]byte("ker")); err != nil {
+				t.Fatal(err)
+			}
+
+			size, r, err := s.Get(ctx, "flatcar/kernel")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			if size != -1 {
+				t.Errorf("size = %d, want -1 while writing", size)
+			}
+			type result struct {
+				data []byte
+				err  error
+			}
+			done := make(chan result, 1)
+			go func() {
+				data, err := io.ReadAll(r)
+				done <- result{data, err}
+			}()
+
+			select {
+			case res := <-done:
+				t.Fatalf("read finished before the transaction did: %q, %v", res.data, res.err)
+			case <-time.After(50 * time.Millisecond):
+			}
+			if _, err := tx.Write([]byte("nel")); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.finish(tx); err != nil {
+				t.Fatal(err)
+			}
+
+			res := <-done
+			if tt.wantErr != nil {
+				if !errors.Is(res.err, tt.wantErr) {
+					t.Fatalf("read error = %v, want %v", res.err, tt.wantErr)
+				}
+				return
+			}
+			if res.err != nil || string(res.data) != tt.want {
+				t.Fatalf("read %q, %v, want %q", res.data, res.err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadWhileWritingCanceled(t *testing.T) {
+	s := newTestStorage(t, FSOption{})
+	tx, err := s.Add(context.Background(), "flatcar/kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, r, err := s.Get(ctx, "flatcar/kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := io.ReadAll(r); !errors.Is(err, context.Canceled) {
+		t.Fatalf("read error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestCorruptedBlob(t *testing.T) {
+	tests := []struct {
+		name string
+		// stored replaces the data of the blob after it was committed
+		stored string
+		// wantGetErr fails Get itself; otherwise the error comes at the end of the data
+		wantGetErr bool
+	}{
+		{name: "other size", stored: "kernel panic", wantGetErr: true},
+		{name: "same size", stored: "kernal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dataDir := filepath.Join(t.TempDir(), "data")
+			s := newTestStorage(t, FSOption{DataDir: dataDir})
+			addBlob(t, s, "flatcar/kernel", "kernel")
+			// a fresh instance has not verified the blob yet
+			s.Close()
+			s = newTestStorage(t, FSOption{DataDir: dataDir})
+			if err := os.WriteFile(filepath.Join(dataDir, "flatcar", "kernel"), []byte(tt.stored), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, r, err := s.Get(ctx, "flatcar/kernel")
+			if tt.wantGetErr {
+				if !errors.Is(err, ErrCorrupted) {
+					t.Fatalf("Get() error = %v, want %v", err, ErrCorrupted)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(r)
+				r.Close()
+				if !errors.Is(err, ErrCorrupted) {
+					t.Fatalf("read error = %v, want %v", err, ErrCorrupted)
+				}
+				// the last bytes are withheld, so that the data cannot be taken for a complete blob
+				if len(data) >= len(tt.stored) {
+					t.Errorf("read %q before failing", data)
+				}
+			}
+
+			if _, _, err := s.Get(ctx, "flatcar/kernel"); !errors.Is(err, ErrNotfound) {
+				t.Fatalf("Get() after quarantining: error = %v, want %v", err, ErrNotfound)
+			}
+			entries, err := os.ReadDir(filepath.Join(dataDir, quarantineDir))
+			if err != nil || len(entries) != 2 {
+				t.Errorf("quarantine holds %v, %v; want the blob and its metadata", entries, err)
+			}
+		})
+	}
+}
+
+func TestVerifiedBlob(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t, FSOption{})
+	addBlob(t, s, "flatcar/kernel", "kernel")
+
+	size, r, err := s.Get(ctx, "flatcar/kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if size != 6 {
+		t.Errorf("size = %d, want 6", size)
+	}
+	// the digest was computed as the blob was written, so it is not checked again
+	if _, ok := r.(*os.File); !ok {
+		t.Errorf("Get() returned a %T, want the file itself", r)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	ctx := context.Background()
+	dataDir := filepath.Join(t.TempDir(), "data")
+	var pinned []string
+	s := newTestStorage(t, FSOption{DataDir: dataDir, Quota: 12, Pinned: func() []string { return pinned }})
+
+	// a is the least recently used, then b, then c
+	for i, key := range []string{"a", "b", "c"} {
+		addBlob(t, s, key, "blob")
+		at := time.Now().Add(time.Duration(i-3) * time.Hour)
+		if err := os.Chtimes(filepath.Join(dataDir, key), at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(key string) bool {
+		_, err := s.Stat(ctx, key)
+		return err == nil
+	}
+
+	pinned = []string{"a"}
+	addBlob(t, s, "d", "blob")
+	if !exists("a") || exists("b") || !exists("c") || !exists("d") {
+		t.Fatal("adding d did not evict b, the least recently used blob that is not pinned")
+	}
+
+	s.Touch(ctx, "c")
+	addBlob(t, s, "e", "blob")
+	if exists("d") || !exists("c") {
+		t.Fatal("adding e did not evict d, which was used less recently than c")
+	}
+
+	pinned = []string{"a", "c", "e"}
+	tx, err := s.Add(ctx, "f")
+	if err == nil {
+		defer tx.Rollback()
+		err = tx.Reserve(4)
+	}
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("adding f with every blob pinned: error = %v, want %v", err, ErrQuotaExceeded)
+	}
+	if used, quota := s.Usage(ctx); used != 12 || quota != 12 {
+		t.Errorf("Usage() = %d, %d; want 12, 12", used, quota)
+	}
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi/slogerr"
+)
+
+type Metadata struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	Signature   []byte    `json:"signature,omitempty"`
+	CommittedAt time.Time `json:"committedAt"`
+}
+
+const (
+	metaDir       = ".meta"
+	quarantineDir = ".quarantine"
+	metaSuffix    = ".json"
+)
+
+func (s *fsStorage) metaPathForKey(key string) string {
+	return filepath.Join(s.dataDir, metaDir, filepath.FromSlash(key)+metaSuffix)
+}
+
+func (s *fsStorage) readMeta(key string) (Metadata, error) {
+	b, err := os.ReadFile(s.metaPathForKey(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return Metadata{}, errtrace.Wrap(ErrNotfound)
+		}
+		return Metadata{}, errtrace.Wrap(err)
+	}
+	var md Metadata
+	if err := json.Unmarshal(b, &md); err != nil {
+		return Metadata{}, errtrace.Wrap(err)
+	}
+	return md, nil
+}
+
+func (s *fsStorage) writeMeta(md Metadata) error {
+	path := s.metaPathForKey(md.Key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return errtrace.Wrap(err)
+	}
+	b, err := json.Marshal(md)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+tempPrefix+"*")
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(b); err != nil {
+		temp.Close()
+		return errtrace.Wrap(err)
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return errtrace.Wrap(err)
+	}
+	if err := temp.Close(); err != nil {
+		return errtrace.Wrap(err)
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return errtrace.Wrap(err)
+	}
+	return nil
+}
+
+func (s *fsStorage) listMeta() ([]Metadata, error) {
+	root := filepath.Join(s.dataDir, metaDir)
+	var mds []Metadata
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), metaSuffix) || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(strings.TrimSuffix(rel, metaSuffix))
+		md, err := s.readMeta(key)
+		if err != nil {
+			slog.Warn("skipping unreadable storage metadata", slog.String("path", path), slogerr.Err(err))
+			return nil
+		}
+		mds = append(mds, md)
+		return nil
+	})
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	return mds, nil
+}
+
+// quarantine moves a blob and its metadata out of the data directory so that it is fetched again.
+func (s *fsStorage) quarantine(key string) error {
+	path, err := s.pathForKey(key)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+
+	dir := filepath.Join(s.dataDir, quarantineDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return errtrace.Wrap(err)
+	}
+	name := strings.ReplaceAll(key, "/", "_") + "." + strconv.FormatInt(time.Now().Unix(), 10)
+
+	var size int64
+	if info, err := os.Stat(path); err == nil {
+		size = info.Size()
+	}
+
+	s.verified.Delete(key)
+	var errs []error
+	if err := os.Rename(path, filepath.Join(dir, name)); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	} else {
+		s.used.Add(-size)
+	}
+	if err := os.Rename(s.metaPathForKey(key), filepath.Join(dir, name+metaSuffix)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return errtrace.Wrap(errors.Join(errs...))
+	}
+
+	slog.Warn("quarantined corrupted blob", slog.String("key", key), slog.String("path", filepath.Join(dir, name)))
+	return nil
+}
+
+// corrupted quarantines a blob that does not match its metadata and returns ErrCorrupted.
+func (s *fsStorage) corrupted(md Metadata, what, expected, actual string) error {
+	slog.Error("storage "+what+" mismatch", slog.String("key", md.Key), slog.String("expected", expected), slog.String("actual", actual))
+	if err := s.quarantine(md.Key); err != nil {
+		slog.Error("Error quarantining blob", slog.String("key", md.Key), slogerr.Err(err))
+	}
+	return errtrace.Wrap(ErrCorrupted)
+}
+
+// verifyingReader checks the size and digest of a stored blob while it is read, and fails
+// with ErrCorrupted when they do not match. It holds back the last bytes of the blob until
+// the digest is known, so that a corrupted blob cannot be taken for a complete one.
+type verifyingReader struct {
+	s       *fsStorage
+	file    *os.File
+	info    fs.FileInfo
+	md      Metadata
+	hash    hash.Hash
+	read    int64
+	checked bool
+	failed  bool
+}
+
+func newVerifyingReader(s *fsStorage, file *os.File, info fs.FileInfo, md Metadata) *verifyingReader {
+	return &verifyingReader{
+		s:    s,
+		file: file,
+		info: info,
+		md:   md,
+		hash: sha256.New(),
+	}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	if r.failed {
+		return 0, errtrace.Wrap(ErrCorrupted)
+	}
+	n, err := r.file.Read(p)
+	r.hash.Write(p[:n])
+	r.read += int64(n)
+	if !r.checked && (r.read >= r.md.Size || err == io.EOF) {
+		r.checked = true
+		if r.read != r.md.Size {
+			r.failed = true
+			return 0, errtrace.Wrap(r.s.corrupted(r.md, "size", strconv.FormatInt(r.md.Size, 10), strconv.FormatInt(r.read, 10)))
+		}
+		if digest := hex.EncodeToString(r.hash.Sum(nil)); digest != r.md.SHA256 {
+			r.failed = true
+			return 0, errtrace.Wrap(r.s.corrupted(r.md, "digest", r.md.SHA256, digest))
+		}
+		r.s.verified.Store(r.md.Key, r.info)
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	return errtrace.Wrap(r.file.Close())
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi/slogerr"
+)
+
+type blobInfo struct {
+	key        string
+	size       int64
+	lastAccess time.Time
+}
+
+// listBlobs walks the data directory, skipping metadata, quarantine and staging entries.
+func (s *fsStorage) listBlobs() ([]blobInfo, error) {
+	var blobs []blobInfo
+	err := filepath.WalkDir(s.dataDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == s.dataDir {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dataDir, path)
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, blobInfo{
+			key:        filepath.ToSlash(rel),
+			size:       info.Size(),
+			lastAccess: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+	return blobs, nil
+}
+
+// Touch records an access to a blob. The modification time doubles as the last access time,
+// because access times are unreliable on relatime or noatime mounts.
+func (s *fsStorage) Touch(ctx context.Context, key string) {
+	path, err := s.pathForKey(key)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		slog.DebugContext(ctx, "cannot record blob access", slog.String("path", path), slogerr.Err(err))
+	}
+}
+
+// reserve accounts n more bytes against the quota, evicting unused blobs when necessary.
+func (s *fsStorage) reserve(ctx context.Context, n int64) error {
+	if s.quota <= 0 {
+		s.used.Add(n)
+		return nil
+	}
+	if n > s.quota {
+		return errtrace.Errorf("%w: %d bytes exceed the quota of %d bytes", ErrQuotaExceeded, n, s.quota)
+	}
+	if s.used.Add(n) <= s.quota {
+		return nil
+	}
+	if err := s.evict(ctx, 0); err != nil {
+		s.used.Add(-n)
+		return errtrace.Errorf("%w: %d more bytes do not fit in the quota of %d bytes", err, n, s.quota)
+	}
+	return nil
+}
+
+// evict removes least recently used blobs that are not pinned until need more bytes fit in the quota.
+func (s *fsStorage) evict(ctx context.Context, need int64) error {
+	var pinned []string
+	if s.pinned != nil {
+		pinned = s.pinned()
+	}
+
+	s.evictMu.Lock()
+	defer s.evictMu.Unlock()
+
+	if s.used.Load()+need <= s.quota {
+		return nil
+	}
+
+	blobs, err := s.listBlobs()
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].lastAccess.Before(blobs[j].lastAccess)
+	})
+
+	for _, b := range blobs {
+		if s.used.Load()+need <= s.quota {
+			return nil
+		}
+		if _, ok := s.running.Load(b.key); ok {
+			continue
+		}
+		if slices.Contains(pinned, b.key) {
+			continue
+		}
+
+		path, err := s.pathForKey(b.key)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				slog.ErrorContext(ctx, "Error evicting blob", slog.String("key", b.key), slogerr.Err(err))
+			}
+			continue
+		}
+		os.Remove(s.metaPathForKey(b.key))
+		s.verified.Delete(b.key)
+		s.used.Add(-b.size)
+		slog.InfoContext(ctx, "evicted blob", slog.String("key", b.key), slog.Int64("size", b.size), slog.Time("lastAccess", b.lastAccess))
+	}
+
+	if s.used.Load()+need > s.quota {
+		return errtrace.Wrap(ErrQuotaExceeded)
+	}
+	return nil
+}
+
+func (s *fsStorage) Usage(ctx context.Context) (used int64, quota int64) {
+	return s.used.Load(), s.quota
+}
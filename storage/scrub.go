@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"braces.dev/errtrace"
+	"github.com/tosuke/hokuchi/slogerr"
+)
+
+var errSignatureMismatch = errtrace.New("storage: signature mismatch")
+
+// Scrubber periodically re-reads stored blobs and quarantines the ones that no longer match their metadata.
+type Scrubber struct {
+	Storage  Storage
+	Interval time.Duration
+	// VerifySignature re-checks blobs that were committed with a detached signature.
+	VerifySignature func(r io.Reader, sig []byte) error
+	// OnCorrupt is called after a corrupted blob has been quarantined.
+	OnCorrupt func(ctx context.Context, key string)
+
+	runs      atomic.Uint64
+	checked   atomic.Uint64
+	corrupted atomic.Uint64
+	failed    atomic.Uint64
+}
+
+type ScrubStats struct {
+	Runs      uint64
+	Checked   uint64
+	Corrupted uint64
+	Failed    uint64
+}
+
+func (sc *Scrubber) Stats() ScrubStats {
+	return ScrubStats{
+		Runs:      sc.runs.Load(),
+		Checked:   sc.checked.Load(),
+		Corrupted: sc.corrupted.Load(),
+		Failed:    sc.failed.Load(),
+	}
+}
+
+func (sc *Scrubber) Run(ctx context.Context) error {
+	if sc.Interval <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(sc.Interval)
+	defer ticker.Stop()
+
+	// blobs may have been damaged while the process was not running
+	for {
+		if err := sc.ScrubOnce(ctx); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Error scrubbing storage", slogerr.Err(err))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (sc *Scrubber) ScrubOnce(ctx context.Context) error {
+	mds, err := sc.Storage.List(ctx)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+
+	var corrupted, failed int
+	for _, md := range mds {
+		if err := ctx.Err(); err != nil {
+			return errtrace.Wrap(err)
+		}
+
+		err := sc.check(ctx, md)
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrNotfound):
+			// removed since listing
+		case errors.Is(err, ErrCorrupted), errors.Is(err, errSignatureMismatch):
+			corrupted++
+			sc.corrupted.Add(1)
+			if errors.Is(err, errSignatureMismatch) {
+				// digest mismatches are quarantined by the reader itself
+				if err := sc.Storage.Quarantine(ctx, md.Key); err != nil {
+					slog.ErrorContext(ctx, "Error quarantining blob", slog.String("key", md.Key), slogerr.Err(err))
+				}
+			}
+			slog.WarnContext(ctx, "scrub found corrupted blob", slog.String("key", md.Key), slogerr.Err(err))
+			if sc.OnCorrupt != nil {
+				sc.OnCorrupt(ctx, md.Key)
+			}
+		default:
+			failed++
+			sc.failed.Add(1)
+			slog.ErrorContext(ctx, "Error scrubbing blob", slog.String("key", md.Key), slogerr.Err(err))
+		}
+		sc.checked.Add(1)
+	}
+	sc.runs.Add(1)
+
+	slog.InfoContext(ctx, "scrubbed storage",
+		slog.Int("checked", len(mds)), slog.Int("corrupted", corrupted), slog.Int("failed", failed))
+	return nil
+}
+
+func (sc *Scrubber) check(ctx context.Context, md Metadata) error {
+	r, err := sc.Storage.Open(ctx, md.Key)
+	if err != nil {
+		return errtrace.Wrap(err)
+	}
+	defer r.Close()
+
+	if len(md.Signature) > 0 && sc.VerifySignature != nil {
+		// the verifier may not wrap the errors of the reader, so they are kept aside
+		er := &errReader{r: r}
+		err := sc.VerifySignature(er, md.Signature)
+		if er.err != nil {
+			return errtrace.Wrap(er.err)
+		}
+		if err != nil {
+			return errtrace.Wrap(errors.Join(errSignatureMismatch, err))
+		}
+		// the digest is only known once the blob has been read to the end
+		if _, err := io.Copy(io.Discard, er); err != nil {
+			return errtrace.Wrap(err)
+		}
+		return nil
+	}
+
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return errtrace.Wrap(err)
+	}
+	return nil
+}
+
+// errReader remembers the first error other than io.EOF returned by r.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
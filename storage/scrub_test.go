@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScrubSignedCorruptedBlob(t *testing.T) {
+	tests := []struct {
+		name   string
+		verify func(r io.Reader, sig []byte) error
+	}{
+		{
+			// like gopenpgp, which does not wrap the errors of the reader
+			name: "reader error hidden",
+			verify: func(r io.Reader, sig []byte) error {
+				if _, err := io.ReadAll(r); err != nil {
+					return fmt.Errorf("error in reading message: %v", err)
+				}
+				return nil
+			},
+		},
+		{
+			name: "stops before the end",
+			verify: func(r io.Reader, sig []byte) error {
+				_, err := r.Read(make([]byte, 1))
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			dataDir := filepath.Join(t.TempDir(), "data")
+			s := newTestStorage(t, FSOption{DataDir: dataDir})
+			tx, err := s.Add(ctx, "flatcar/kernel")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx.SetSignature([]byte("sig"))
+			if _, err := tx.Write([]byte("kernel")); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.Commit(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dataDir, "flatcar", "kernel"), []byte("kernal"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			var corrupted []string
+			sc := &Scrubber{
+				Storage:         s,
+				VerifySignature: tt.verify,
+				OnCorrupt:       func(_ context.Context, key string) { corrupted = append(corrupted, key) },
+			}
+			if err := sc.ScrubOnce(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if len(corrupted) != 1 || corrupted[0] != "flatcar/kernel" {
+				t.Fatalf("OnCorrupt called for %v", corrupted)
+			}
+			if _, _, err := s.Get(ctx, "flatcar/kernel"); !errors.Is(err, ErrNotfound) {
+				t.Fatalf("Get() after scrubbing: error = %v, want %v", err, ErrNotfound)
+			}
+			if stats := sc.Stats(); stats.Corrupted != 1 || stats.Failed != 0 {
+				t.Errorf("Stats() = %+v", stats)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"io"
+	"strings"
 
 	"braces.dev/errtrace"
 )
@@ -10,17 +11,80 @@ import (
 type TxWriter interface {
 	io.Writer
 
+	// SetSignature keeps a detached signature of the data so that it can be verified again later.
+	SetSignature(sig []byte)
+	// Reserve makes room for a blob of size bytes before it is written, evicting unused blobs as needed.
+	// It fails with ErrQuotaExceeded if the blob cannot fit, and the transaction should then be rolled back.
+	Reserve(size int64) error
+	// Rollback discards the transaction. It does nothing once the transaction has been committed or has failed to.
 	Rollback() error
+	// Commit stores the blob. If it fails, the transaction is rolled back and its reservation released,
+	// so there is nothing left to roll back.
 	Commit(ctx context.Context) error
 }
 
 type Storage interface {
+	// Get opens the blob stored at key. If the size of a committed blob does not match its metadata,
+	// the blob is quarantined and Get fails with ErrCorrupted. Until a blob has been read through once,
+	// r checks its digest as it goes: it withholds the last bytes and fails with ErrCorrupted on a mismatch.
+	// While the blob is still being written, size is -1 and r streams the data as it arrives.
 	Get(ctx context.Context, key string) (size int64, r io.ReadCloser, err error)
+	// Open opens the committed blob at key for maintenance such as scrubbing. It does not rely on
+	// an earlier verification: r recomputes the digest and fails with ErrCorrupted at the end if it does not match.
+	Open(ctx context.Context, key string) (r io.ReadCloser, err error)
+	// Touch records that the blob at key has been served, so that eviction keeps it over blobs served less recently.
+	Touch(ctx context.Context, key string)
 	Add(ctx context.Context, key string) (TxWriter, error)
+	// Stat returns the metadata recorded when the blob at key was committed.
+	Stat(ctx context.Context, key string) (Metadata, error)
+	List(ctx context.Context) ([]Metadata, error)
+	// Quarantine moves a corrupted blob aside so that it is no longer served.
+	Quarantine(ctx context.Context, key string) error
+	// Usage reports the bytes currently stored and the configured quota, which is zero when unlimited.
+	Usage(ctx context.Context) (used int64, quota int64)
+	// Check reports an error if new blobs cannot be written.
+	Check(ctx context.Context) error
 	Close() error
 }
 
 var (
-	ErrNotfound = errtrace.New("storage: not found")
-	ErrExists   = errtrace.New("storage: already exists")
+	ErrNotfound      = errtrace.New("storage: not found")
+	ErrExists        = errtrace.New("storage: already exists")
+	ErrInvalidKey    = errtrace.New("storage: invalid key")
+	ErrAborted       = errtrace.New("storage: write aborted")
+	ErrCorrupted     = errtrace.New("storage: digest mismatch")
+	ErrQuotaExceeded = errtrace.New("storage: quota exceeded")
 )
+
+const maxKeySegmentLen = 255
+
+// ValidKey reports whether key is a well-formed storage key.
+// A key is one or more "/"-separated segments. Each segment starts with an
+// ASCII letter or digit, followed by letters, digits, '.', '_' or '-'.
+func ValidKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if !validKeySegment(seg) {
+			return false
+		}
+	}
+	return true
+}
+
+func validKeySegment(seg string) bool {
+	if seg == "" || len(seg) > maxKeySegmentLen {
+		return false
+	}
+	for i := 0; i < len(seg); i++ {
+		c := seg[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case i > 0 && (c == '.' || c == '_' || c == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
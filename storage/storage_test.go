@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{key: "flatcar/stable/amd64/3815.2.0/kernel", want: true},
+		{key: "a", want: true},
+		{key: "a.b_c-d", want: true},
+		{key: strings.Repeat("a", maxKeySegmentLen), want: true},
+		{key: ""},
+		{key: strings.Repeat("a", maxKeySegmentLen+1)},
+		{key: "/a"},
+		{key: "a/"},
+		{key: "a//b"},
+		{key: "."},
+		{key: ".."},
+		{key: "a/../b"},
+		{key: ".meta/a"},
+		{key: "-a"},
+		{key: "a b"},
+		{key: `a\b`},
+		{key: "a:b"},
+		{key: "café"},
+		{key: "a\x00"},
+	}
+	for _, tt := range tests {
+		if got := ValidKey(tt.key); got != tt.want {
+			t.Errorf("ValidKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
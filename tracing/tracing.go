@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+
+	"braces.dev/errtrace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type Option struct {
+	// Endpoint is the host:port of an OTLP/HTTP collector. Tracing is disabled when empty.
+	Endpoint string
+	Insecure bool
+	// SampleRatio is the fraction of new traces that are recorded.
+	SampleRatio float64
+}
+
+// Setup installs a global tracer provider exporting to the configured collector.
+// The returned function flushes pending spans and must be called on shutdown.
+func Setup(ctx context.Context, option Option) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if option.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(option.Endpoint)}
+	if option.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("hokuchi"),
+	))
+	if err != nil {
+		return nil, errtrace.Wrap(err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(option.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		return errtrace.Wrap(tp.Shutdown(ctx))
+	}, nil
+}
+
+// LogHandler adds the trace and span IDs of the context to every record, at the top level
+// even when the record is logged within a group.
+type LogHandler struct {
+	slog.Handler
+	// root is the handler without any of the attributes and groups added since,
+	// which are replayed in ops on top of the IDs
+	root slog.Handler
+	ops  []func(slog.Handler) slog.Handler
+}
+
+func NewLogHandler(h slog.Handler) *LogHandler {
+	return &LogHandler{Handler: h, root: h}
+}
+
+func (h *LogHandler) Handle(ctx context.Context, r slog.Record) error {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return h.Handler.Handle(ctx, r)
+	}
+	handler := h.root.WithAttrs([]slog.Attr{
+		slog.String("trace_id", sc.TraceID().String()),
+		slog.String("span_id", sc.SpanID().String()),
+	})
+	for _, op := range h.ops {
+		handler = op(handler)
+	}
+	return handler.Handle(ctx, r)
+}
+
+func (h *LogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(h slog.Handler) slog.Handler { return h.WithAttrs(attrs) })
+}
+
+func (h *LogHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(h slog.Handler) slog.Handler { return h.WithGroup(name) })
+}
+
+func (h *LogHandler) with(op func(slog.Handler) slog.Handler) *LogHandler {
+	return &LogHandler{
+		Handler: op(h.Handler),
+		root:    h.root,
+		ops:     append(slices.Clip(h.ops), op),
+	}
+}